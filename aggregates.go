@@ -0,0 +1,223 @@
+package kendo
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// Aggregator computes an aggregate of the values of a field, such as "sum".
+// Expressions are MongoDB aggregation expressions, e.g. {"$sum": values}.
+type Aggregator struct {
+	// Expression computes the aggregate of a group from the array of its values, e.g. "$items.price"
+	Expression func(values interface{}) interface{}
+	// Accumulator computes the aggregate of all the documents in a $group stage from the field, e.g. "$price".
+	// If not set, the values of all the documents are pushed to an array and Expression is used.
+	Accumulator func(field interface{}) bson.M
+	// Combine, if set, computes the aggregate of a group from the array of the aggregates of its
+	// subgroups instead of from its values
+	Combine func(aggregates interface{}) interface{}
+	// Finalize, if set, computes the aggregate from the accumulated value after the $group stage
+	Finalize func(accumulated interface{}) interface{}
+	// Documents makes the values the documents instead of the values of the field, e.g. for count
+	Documents bool
+	// Ordered makes the values follow the sort of the DataState, e.g. for first
+	Ordered bool
+}
+
+// AggregateFunc returns the Aggregator of an aggregate given its arguments,
+// e.g. "90" for percentile(90), or an error if they are invalid
+type AggregateFunc func(args ...string) (*Aggregator, error)
+
+var (
+	aggregatorsMutex sync.RWMutex
+	aggregators      = map[string]AggregateFunc{
+		"count": aggregate(Aggregator{
+			Expression:  func(values interface{}) interface{} { return bson.M{"$size": values} },
+			Accumulator: func(field interface{}) bson.M { return bson.M{"$sum": 1} },
+			Combine:     func(aggregates interface{}) interface{} { return bson.M{"$sum": aggregates} },
+			Documents:   true,
+		}),
+		"sum":        combined("$sum"),
+		"min":        combined("$min"),
+		"max":        combined("$max"),
+		"average":    accumulated("$avg"),
+		"stdDevPop":  accumulated("$stdDevPop"),
+		"stdDevSamp": accumulated("$stdDevSamp"),
+		"countDistinct": aggregate(Aggregator{
+			Expression: func(values interface{}) interface{} {
+				return bson.M{"$size": bson.M{"$setUnion": []interface{}{values}}}
+			},
+			Accumulator: func(field interface{}) bson.M { return bson.M{"$addToSet": field} },
+			Finalize:    func(accumulated interface{}) interface{} { return bson.M{"$size": accumulated} },
+		}),
+		"median": aggregate(Aggregator{
+			Expression:  func(values interface{}) interface{} { return median(values) },
+			Accumulator: median,
+		}),
+		"percentile": percentileAggregate,
+		"first": aggregate(Aggregator{
+			Expression:  func(values interface{}) interface{} { return bson.M{"$arrayElemAt": []interface{}{values, 0}} },
+			Accumulator: func(field interface{}) bson.M { return bson.M{"$first": field} },
+			Ordered:     true,
+		}),
+		"last": aggregate(Aggregator{
+			Expression:  func(values interface{}) interface{} { return bson.M{"$arrayElemAt": []interface{}{values, -1}} },
+			Accumulator: func(field interface{}) bson.M { return bson.M{"$last": field} },
+			Ordered:     true,
+		}),
+	}
+)
+
+// RegisterAggregate registers an aggregate, replacing any existing one, built-ins included.
+// Aggregates are requested by name, or by name and arguments, e.g. price-percentile(90).
+func RegisterAggregate(name string, fn AggregateFunc) {
+	aggregatorsMutex.Lock()
+	defer aggregatorsMutex.Unlock()
+
+	aggregators[name] = fn
+}
+
+// getAggregator returns the Aggregator of the aggregate
+func (ad AggregateDescriptor) getAggregator() (*Aggregator, error) {
+
+	name, args := ad.Aggregate, []string{}
+	if i := strings.Index(name, "("); i > 0 && strings.HasSuffix(name, ")") {
+		name, args = name[:i], strings.Split(name[i+1:len(name)-1], ",")
+	}
+
+	aggregatorsMutex.RLock()
+	fn, ok := aggregators[name]
+	aggregatorsMutex.RUnlock()
+	if !ok {
+		return nil, &AggregateError{
+			Field:     ad.Field,
+			Aggregate: ad.Aggregate,
+			Reason:    "unknown aggregate",
+		}
+	}
+
+	aggregator, err := fn(args...)
+	if err == nil && aggregator.Expression == nil {
+		err = errors.New("expected an expression")
+	}
+	if err != nil {
+		return nil, &AggregateError{
+			Field:     ad.Field,
+			Aggregate: ad.Aggregate,
+			Reason:    err.Error(),
+		}
+	}
+
+	return aggregator, nil
+}
+
+// checkAggregates returns an AggregateError for the first unknown or invalid aggregate
+func (d *DataState) checkAggregates() error {
+
+	aggregates := append([]AggregateDescriptor{}, d.Aggregates...)
+	for _, g := range d.Group {
+		aggregates = append(aggregates, g.Aggregates...)
+	}
+
+	for _, a := range aggregates {
+		if _, err := a.getAggregator(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// isOrdered reports whether an aggregate, of the DataState or of its groups, needs the documents
+// in the order of the sort
+func (d *DataState) isOrdered() bool {
+
+	aggregates := append([]AggregateDescriptor{}, d.Aggregates...)
+	for _, g := range d.Group {
+		aggregates = append(aggregates, g.Aggregates...)
+	}
+
+	for _, a := range aggregates {
+		if aggregator, err := a.getAggregator(); err == nil && aggregator.Ordered {
+			return true
+		}
+	}
+
+	return false
+}
+
+// aggregate returns an AggregateFunc without arguments
+func aggregate(aggregator Aggregator) AggregateFunc {
+	return func(args ...string) (*Aggregator, error) {
+		if len(args) > 0 {
+			return nil, errors.New("expected no arguments")
+		}
+
+		return &aggregator, nil
+	}
+}
+
+// accumulated returns an aggregate computed with an operator that is both an accumulator
+// and an array expression, such as $avg
+func accumulated(operator string) AggregateFunc {
+	return aggregate(Aggregator{
+		Expression:  func(values interface{}) interface{} { return bson.M{operator: values} },
+		Accumulator: func(field interface{}) bson.M { return bson.M{operator: field} },
+	})
+}
+
+// combined returns an accumulated aggregate also computed from the aggregates of the subgroups,
+// e.g. a sum of sums
+func combined(operator string) AggregateFunc {
+	return aggregate(Aggregator{
+		Expression:  func(values interface{}) interface{} { return bson.M{operator: values} },
+		Accumulator: func(field interface{}) bson.M { return bson.M{operator: field} },
+		Combine:     func(aggregates interface{}) interface{} { return bson.M{operator: aggregates} },
+	})
+}
+
+// median requires MongoDB 7.0
+func median(input interface{}) bson.M {
+	return bson.M{
+		"$median": bson.M{
+			"input":  input,
+			"method": "approximate",
+		},
+	}
+}
+
+// percentileAggregate takes the percentile as an integer between 0 and 100 and requires MongoDB 7.0
+func percentileAggregate(args ...string) (*Aggregator, error) {
+
+	if len(args) != 1 {
+		return nil, errors.New("expected a percentile")
+	}
+	p, err := strconv.Atoi(strings.TrimSpace(args[0]))
+	if err != nil || p < 0 || p > 100 {
+		return nil, fmt.Errorf("expected a percentile between 0 and 100, got %q", args[0])
+	}
+
+	percentile := func(input interface{}) bson.M {
+		return bson.M{
+			"$percentile": bson.M{
+				"input":  input,
+				"p":      []interface{}{float64(p) / 100},
+				"method": "approximate",
+			},
+		}
+	}
+	first := func(percentiles interface{}) interface{} { // $percentile returns an array
+		return bson.M{"$arrayElemAt": []interface{}{percentiles, 0}}
+	}
+
+	return &Aggregator{
+		Expression:  func(values interface{}) interface{} { return first(percentile(values)) },
+		Accumulator: percentile,
+		Finalize:    first,
+	}, nil
+}
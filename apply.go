@@ -8,31 +8,50 @@ import (
 	"github.com/globalsign/mgo/bson"
 )
 
-// Apply will parse the request values and retrieves the DataResult from a collection
+// Apply will parse the request values, unless Parse was called, and retrieves the DataResult from a collection
 func (d *DataState) Apply(collection mgo.Collection) (dataResult DataResult, err error) {
-	if err = d.parse(); err != nil {
+	if !d.parsed {
+		if err = d.parse(); err != nil {
+			return
+		}
+	}
+
+	total, aggregates, err := d.getTotal(collection)
+	if err != nil {
 		return
 	}
 
-	total, err := d.getTotal(collection)
+	pipeline, err := d.getPipeline()
 	if err != nil {
 		return
 	}
 
-	aggregate := collection.Pipe(d.getPipeline())
+	aggregate := collection.Pipe(pipeline)
+	if d.collation != nil {
+		aggregate.Collation(d.collation)
+	}
 
 	data := []interface{}{}
-	err = aggregate.All(&data)
+	if err = aggregate.All(&data); err != nil {
+		return
+	}
 
 	return DataResult{
-		Data:  data,
-		Total: total,
+		Data:       data,
+		Total:      total,
+		Aggregates: aggregates,
 	}, nil
 }
 
 func (d *DataState) getBasePipeline() (pipeline []bson.M) {
 
-	pipeline = []bson.M{
+	pipeline = []bson.M{}
+
+	if text := d.getTextSearch(); text != nil {
+		pipeline = append(pipeline, text)
+	}
+
+	pipeline = append(pipeline, []bson.M{
 		{
 			"$addFields": bson.M{
 				"id": "$_id",
@@ -43,7 +62,7 @@ func (d *DataState) getBasePipeline() (pipeline []bson.M) {
 				"_id": 0,
 			},
 		},
-	}
+	}...)
 
 	if len(d.preprocessing) > 0 {
 		pipeline = append(pipeline, d.preprocessing...)
@@ -52,7 +71,11 @@ func (d *DataState) getBasePipeline() (pipeline []bson.M) {
 	return
 }
 
-func (d *DataState) getPipeline() (pipeline []bson.M) {
+func (d *DataState) getPipeline() (pipeline []bson.M, err error) {
+
+	if err = d.checkAggregates(); err != nil {
+		return nil, err
+	}
 
 	pipeline = d.getBasePipeline()
 
@@ -60,17 +83,28 @@ func (d *DataState) getPipeline() (pipeline []bson.M) {
 		pipeline = append(pipeline, d.getLookups()...)
 	}
 
-	if len(d.Filter.Filters) > 0 {
-		pipeline = append(pipeline, bson.M{"$match": d.getFilter()})
+	if len(d.Filter.Filters) > 0 || d.getSearch() != nil {
+		var filter bson.M
+		if filter, err = d.getFilter(); err != nil {
+			return nil, err
+		}
+		pipeline = append(pipeline, bson.M{"$match": filter})
+	}
+
+	if project := d.getExposedProject(); project != nil {
+		pipeline = append(pipeline, project)
 	}
 
 	if len(d.Group) > 0 {
+		if sort := d.getDocumentsSort(); sort != nil { // items of the groups in order
+			pipeline = append(pipeline, sort)
+		}
 		pipeline = append(pipeline, d.getGroups()...)
 		pipeline = append(pipeline, d.getProject())
 	}
 
-	if len(d.Sort) > 0 {
-		pipeline = append(pipeline, d.getSortFields())
+	if sort := d.getSortFields(); sort != nil {
+		pipeline = append(pipeline, sort)
 	}
 
 	if d.PageSize > 0 {
@@ -80,25 +114,47 @@ func (d *DataState) getPipeline() (pipeline []bson.M) {
 	return
 }
 
-func (d *DataState) getTotalPipeline() (pipeline []bson.M) {
+func (d *DataState) getTotalPipeline() (pipeline []bson.M, err error) {
+
+	if err = d.checkAggregates(); err != nil {
+		return nil, err
+	}
 
 	lookupsMap := map[string]LookupDescriptor{}
 	for _, lookup := range d.Lookup {
 		lookupsMap[lookup.As] = lookup
 	}
 
+	fields := []string{}
+	for _, f := range d.Filter.leaves() {
+		fields = append(fields, f.Field)
+	}
+	if d.getSearch() != nil {
+		fields = append(fields, d.searchFields...)
+	}
+
 	// apply lookups only if needed by filter
 	lookupsToApply := []LookupDescriptor{}
-	for _, f := range d.Filter.Filters {
-		rootKey := strings.Split(f.Field, ".")[0]
+	for _, field := range fields {
+		rootKey := strings.Split(field, ".")[0]
 		if lookup, found := lookupsMap[rootKey]; found {
 			lookupsToApply = append(lookupsToApply, lookup)
 		}
 	}
 
+	// aggregated lookup fields need single lookups to be documents
+	aggregatesLookups := false
+	for _, a := range d.Aggregates {
+		if _, found := lookupsMap[strings.Split(a.Field, ".")[0]]; found {
+			aggregatesLookups = true
+		}
+	}
+
 	pipeline = d.getBasePipeline()
 
-	if len(lookupsToApply) > 0 {
+	if aggregatesLookups {
+		pipeline = append(pipeline, d.getLookups()...)
+	} else if len(lookupsToApply) > 0 {
 		for _, l := range d.Lookup {
 			pipeline = append(pipeline, bson.M{
 				"$lookup": bson.M{
@@ -111,8 +167,23 @@ func (d *DataState) getTotalPipeline() (pipeline []bson.M) {
 		}
 	}
 
-	if len(d.Filter.Filters) > 0 {
-		pipeline = append(pipeline, bson.M{"$match": d.getFilter()})
+	if len(d.Filter.Filters) > 0 || d.getSearch() != nil {
+		var filter bson.M
+		if filter, err = d.getFilter(); err != nil {
+			return nil, err
+		}
+		pipeline = append(pipeline, bson.M{"$match": filter})
+	}
+
+	if len(d.Aggregates) > 0 {
+		if sort := d.getDocumentsSort(); sort != nil && d.isOrdered() {
+			pipeline = append(pipeline, sort)
+		}
+		pipeline = append(pipeline, d.getTotalGroup())
+		if finalize := d.getTotalFinalize(); finalize != nil {
+			pipeline = append(pipeline, finalize)
+		}
+		return
 	}
 
 	pipeline = append(pipeline, bson.M{
@@ -122,14 +193,99 @@ func (d *DataState) getTotalPipeline() (pipeline []bson.M) {
 	return
 }
 
-func (d *DataState) getTotal(collection mgo.Collection) (total int, err error) {
+// getTotalGroup returns the $group stage counting the documents and computing their aggregates,
+// the aggregate i is computed in the field aggregate<i>
+func (d *DataState) getTotalGroup() bson.M {
+
+	group := bson.M{
+		"_id": nil,
+		"total": bson.M{
+			"$sum": 1,
+		},
+	}
+	for i, a := range d.Aggregates {
+		group[fmt.Sprintf("aggregate%d", i)] = a.getTotalAccumulator()
+	}
+
+	return bson.M{
+		"$group": group,
+	}
+}
+
+// getTotalFinalize returns the $addFields stage finalizing the aggregates computed by getTotalGroup,
+// or nil if none needs it
+func (d *DataState) getTotalFinalize() bson.M {
+
+	fields := bson.M{}
+	for i, a := range d.Aggregates {
+		aggregator, err := a.getAggregator()
+		if err != nil {
+			continue
+		}
+		key := fmt.Sprintf("aggregate%d", i)
+		switch {
+		case aggregator.Accumulator == nil: // values pushed by getTotalGroup
+			fields[key] = aggregator.Expression("$" + key)
+		case aggregator.Finalize != nil:
+			fields[key] = aggregator.Finalize("$" + key)
+		}
+	}
+
+	if len(fields) == 0 {
+		return nil
+	}
+
+	return bson.M{
+		"$addFields": fields,
+	}
+}
+
+// getTotalAggregates returns the aggregates computed by getTotalGroup keyed by field and aggregate,
+// or nil if there are no aggregates
+func (d *DataState) getTotalAggregates(data bson.M) (aggregates map[string]map[string]interface{}) {
+
+	if len(d.Aggregates) == 0 {
+		return nil
+	}
+
+	aggregates = map[string]map[string]interface{}{}
+	for i, a := range d.Aggregates {
+		value := data[fmt.Sprintf("aggregate%d", i)]
+		if value == nil && a.Aggregate == "count" { // no documents
+			value = 0
+		}
+		if aggregates[a.Field] == nil {
+			aggregates[a.Field] = map[string]interface{}{}
+		}
+		aggregates[a.Field][a.Aggregate] = value
+	}
+
+	return
+}
+
+func (d *DataState) getTotal(collection mgo.Collection) (total int, aggregates map[string]map[string]interface{}, err error) {
 
 	var data struct {
-		Total int `bson:"total"`
+		Total      int    `bson:"total"`
+		Aggregates bson.M `bson:",inline"`
+	}
+	pipeline, err := d.getTotalPipeline()
+	if err != nil {
+		return
 	}
-	err = collection.Pipe(d.getTotalPipeline()).One(&data)
 
-	return data.Total, err
+	pipe := collection.Pipe(pipeline)
+	if d.collation != nil {
+		pipe.Collation(d.collation)
+	}
+	if err = pipe.One(&data); err == mgo.ErrNotFound { // no document matches
+		err = nil
+	}
+	if err != nil {
+		return
+	}
+
+	return data.Total, d.getTotalAggregates(data.Aggregates), nil
 }
 
 func (d *DataState) getLookups() (lookups []bson.M) {
@@ -226,32 +382,63 @@ func (d *DataState) getFirstGrouping() (group bson.M) {
 	return
 }
 
-func (d *DataState) addAggregates(m bson.M, isLast bool) bson.M {
+// getGroupAggregates returns the aggregates of the groups of a level, those of the DataState
+// and those of the GroupDescriptor, without duplicates
+func (d *DataState) getGroupAggregates(level int) (aggregates []AggregateDescriptor) {
+
+	seen := map[AggregateDescriptor]bool{}
+	for _, a := range append(append([]AggregateDescriptor{}, d.Aggregates...), d.Group[level].Aggregates...) {
+		if !seen[a] {
+			seen[a] = true
+			aggregates = append(aggregates, a)
+		}
+	}
+
+	return
+}
+
+// addAggregates adds the aggregates of a group of a level to m,
+// keyed by field as Kendo expects, e.g. {"price": {"sum": 10}}
+func (d *DataState) addAggregates(m bson.M, level int) bson.M {
 
 	aggregates := bson.M{}
+	fields := []string{} // in order, for $arrayToObject
+	dotted := false
 
-	for _, a := range d.Aggregates {
-		key := a.getKey()
-		aggregate := bson.M{
-			a.getAggregate(): a.getExpression(isLast),
-		}
+	var sort bson.D
+	if s := d.getDocumentsSort(); s != nil {
+		sort = s["$sort"].(bson.D)
+	}
 
-		if agg, ok := aggregates[key]; ok {
-			m, _ := agg.(bson.M)
-			m[a.Aggregate] = aggregate
-			aggregates[key] = m
-		} else {
-			aggregates[key] = bson.M{
-				a.Aggregate: aggregate,
-			}
+	levels := len(d.Group) - 1 - level
+	subgroupAggregates := map[AggregateDescriptor]bool{}
+	if levels > 0 {
+		for _, a := range d.getGroupAggregates(level + 1) {
+			subgroupAggregates[a] = true
 		}
 	}
 
-	if len(aggregates) == 0 {
-		aggregates["_"] = nil //cannot project an empty object
+	for _, a := range d.getGroupAggregates(level) {
+		if _, ok := aggregates[a.Field]; !ok {
+			aggregates[a.Field] = bson.M{}
+			fields = append(fields, a.Field)
+		}
+		aggregates[a.Field].(bson.M)[a.Aggregate] = a.getAccumulator(levels, subgroupAggregates[a], sort)
+		dotted = dotted || strings.Contains(a.Field, ".")
 	}
 
-	m["aggregates"] = aggregates
+	switch {
+	case len(aggregates) == 0: // cannot project an empty object
+		m["aggregates"] = bson.M{"$literal": bson.M{}}
+	case dotted: // fields of an expression object cannot contain dots, requires MongoDB 5.0
+		pairs := []interface{}{}
+		for _, field := range fields {
+			pairs = append(pairs, bson.M{"k": field, "v": aggregates[field]})
+		}
+		m["aggregates"] = bson.M{"$arrayToObject": []interface{}{pairs}}
+	default:
+		m["aggregates"] = aggregates
+	}
 
 	return m
 }
@@ -260,32 +447,53 @@ func (d *DataState) getProject() (project bson.M) {
 	firstGroup := d.Group[0]
 
 	value := "$_id"
-	isLast := (len(d.Group) == 1)
-	if isLast {
+	levels := len(d.Group) - 1
+	if levels == 0 {
 		value = fmt.Sprintf("$_id.%s", firstGroup.getKey())
 	}
 	project = bson.M{
 		"$project": d.addAggregates(bson.M{
-			"_id":   0,
-			"value": value,
-			"items": "$items",
-			"field": firstGroup.Field,
-		}, isLast),
+			"_id":          0,
+			"value":        value,
+			"items":        "$items",
+			"field":        firstGroup.Field,
+			"hasSubgroups": bson.M{"$literal": levels > 0}, // true would include the field
+		}, 0),
 	}
 
 	return
 }
 
+// getSortFields returns the $sort stage, or nil if there is nothing to sort on. Groups do not
+// have the sorted fields, their documents are sorted before grouping and groups are sorted by getGroups.
 func (d *DataState) getSortFields() (sort bson.M) {
-	var fields bson.M
-	for _, s := range d.Sort {
-		fields = bson.M{
-			s.Field: 1,
-		}
+	if len(d.Group) > 0 {
+		return nil
+	}
+
+	return d.getDocumentsSort()
+}
 
+// getDocumentsSort returns the $sort stage of the documents, before they are grouped,
+// or nil if there is nothing to sort on
+func (d *DataState) getDocumentsSort() (sort bson.M) {
+	fields := bson.D{}
+	sorted := map[string]bool{}
+	for _, s := range d.Sort {
+		direction := 1
 		if s.Dir == "desc" {
-			fields[s.Field] = -1
+			direction = -1
 		}
+		fields = append(fields, bson.DocElem{Name: s.Field, Value: direction})
+		sorted[s.Field] = true
+	}
+
+	if tiebreaker := d.getTiebreaker(); tiebreaker != "" && !sorted[tiebreaker] {
+		fields = append(fields, bson.DocElem{Name: tiebreaker, Value: 1})
+	}
+
+	if len(fields) == 0 {
+		return nil
 	}
 
 	return bson.M{
@@ -293,27 +501,46 @@ func (d *DataState) getSortFields() (sort bson.M) {
 	}
 }
 
-func (d *DataState) getFilter() (filter bson.M) {
-	filter = bson.M{}
+func (d *DataState) getTiebreaker() string {
+	if d.tiebreaker != nil {
+		return *d.tiebreaker
+	}
 
-	for _, f := range d.Filter.Filters {
-		f.filter(filter)
+	return DefaultTiebreaker
+}
+
+// getFilter returns the filter combined with the search condition
+func (d *DataState) getFilter() (filter bson.M, err error) {
+
+	if filter, err = d.Filter.filter(d); err != nil {
+		return
 	}
 
-	return
+	search := d.getSearch()
+	switch {
+	case search == nil:
+		return
+	case len(filter) == 0:
+		return search, nil
+	}
+
+	return bson.M{
+		"$and": []bson.M{filter, search},
+	}, nil
 }
 
 func (d *DataState) getGroup(id interface{}, value string, field string, depth int) (group bson.M) {
-	isLast := (len(d.Group) - 2) == depth
+	levels := len(d.Group) - 2 - depth // of the pushed group
 	group = bson.M{
 		"$group": bson.M{
 			"_id": id,
 			"items": bson.M{
 				"$push": d.addAggregates(bson.M{
-					"value": fmt.Sprintf("$_id.%s", value),
-					"items": "$items",
-					"field": field,
-				}, isLast),
+					"value":        fmt.Sprintf("$_id.%s", value),
+					"items":        "$items",
+					"field":        field,
+					"hasSubgroups": bson.M{"$literal": levels > 0},
+				}, depth+1),
 			},
 		},
 	}
@@ -325,7 +552,7 @@ func (d *DataState) getPaging() (paging []bson.M) {
 	page := d.Page - 1
 
 	return []bson.M{
-		{"$skip": page * d.PageSize},
+		{"$skip": page*d.PageSize + d.offset},
 		{"$limit": d.PageSize},
 	}
 }
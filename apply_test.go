@@ -1,9 +1,13 @@
 package kendo
 
 import (
+	"errors"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/globalsign/mgo"
 	"github.com/globalsign/mgo/bson"
 )
 
@@ -40,11 +44,12 @@ func TestDataState(t *testing.T) {
 				},
 				Filter: CompositeFilterDescriptor{
 					Logic: "and",
-					Filters: []FilterDescriptor{
-						{
-							Field:    "data.email",
-							Operator: "contains",
-							Value:    "a",
+					Filters: []Filter{
+						&FilterDescriptor{
+							Field:      "data.email",
+							Operator:   "contains",
+							Value:      "a",
+							IgnoreCase: true,
 						},
 					},
 				},
@@ -60,6 +65,16 @@ func TestDataState(t *testing.T) {
 				},
 			}
 
+			// dotted fields are aggregated from the documents of the subgroups
+			commissions := bson.M{
+				"$reduce": bson.M{
+					"input":        "$items.items.commission.due",
+					"initialValue": []interface{}{},
+					"in": bson.M{
+						"$concatArrays": []interface{}{"$$value", "$$this"},
+					},
+				},
+			}
 			wantPipeline := []bson.M{
 				{
 					"$addFields": bson.M{
@@ -136,21 +151,117 @@ func TestDataState(t *testing.T) {
 						"_id": "$_id.dataemail",
 						"items": bson.M{
 							"$push": bson.M{
-								"value": "$_id.vendoremail",
-								"items": "$items",
-								"field": "vendor.email",
+								"value":        "$_id.vendoremail",
+								"items":        "$items",
+								"field":        "vendor.email",
+								"hasSubgroups": bson.M{"$literal": false},
 								"aggregates": bson.M{
-									"commissiondue": bson.M{
-										"average": bson.M{
-											"$avg": "$items.commission.due",
+									"$arrayToObject": []interface{}{
+										[]interface{}{
+											bson.M{
+												"k": "commission.due",
+												"v": bson.M{
+													"average": bson.M{
+														"$avg": "$items.commission.due",
+													},
+													"sum": bson.M{
+														"$sum": "$items.commission.due",
+													},
+												},
+											},
 										},
-										"sum": bson.M{
-											"$sum": "$items.commission.due",
+									},
+								},
+							},
+						},
+					},
+				},
+				{
+					"$sort": bson.M{
+						"_id": 1,
+					},
+				},
+				{
+					"$project": bson.M{
+						"value":        "$_id",
+						"items":        "$items",
+						"field":        "data.email",
+						"hasSubgroups": bson.M{"$literal": true},
+						"aggregates": bson.M{
+							"$arrayToObject": []interface{}{
+								[]interface{}{
+									bson.M{
+										"k": "commission.due",
+										"v": bson.M{
+											"average": bson.M{"$avg": commissions},
+											"sum":     bson.M{"$sum": commissions},
 										},
 									},
 								},
 							},
 						},
+						"_id": 0,
+					},
+				},
+			}
+
+			gotPipeline, err := ds.getPipeline()
+			if err != nil {
+				t.Fatalf("DataState.getPipeline() error = %v", err)
+			}
+			if !reflect.DeepEqual(gotPipeline, wantPipeline) {
+				t.Errorf("DataState.getPipeline() = %v, want %v", gotPipeline, wantPipeline)
+			}
+		})
+
+		t.Run("Should compute count, min and max at every group level", func(t *testing.T) {
+			ds := DataState{
+				Aggregates: []AggregateDescriptor{
+					{Aggregate: "count", Field: "price"},
+					{Aggregate: "min", Field: "price"},
+					{Aggregate: "max", Field: "price"},
+				},
+				Group: []GroupDescriptor{
+					{Field: "category", Dir: "asc"},
+					{Field: "brand", Dir: "asc"},
+				},
+			}
+
+			wantPipeline := append(ds.getBasePipeline(), []bson.M{
+				{
+					"$group": bson.M{
+						"_id": bson.M{
+							"category": "$category",
+							"brand":    "$brand",
+						},
+						"items": bson.M{
+							"$push": "$$ROOT",
+						},
+					},
+				},
+				{
+					"$sort": bson.M{
+						"_id.brand": 1,
+					},
+				},
+				{
+					"$group": bson.M{
+						"_id": "$_id.category",
+						"items": bson.M{
+							"$push": bson.M{
+								"value":        "$_id.brand",
+								"items":        "$items",
+								"field":        "brand",
+								"hasSubgroups": bson.M{"$literal": false},
+								"aggregates": bson.M{
+									"price": bson.M{
+										"count": bson.M{"$size": "$items"},
+										"min":   bson.M{"$min": "$items.price"},
+										"max":   bson.M{"$max": "$items.price"},
+									},
+								},
+							},
+						},
 					},
 				},
 				{
@@ -160,29 +271,343 @@ func TestDataState(t *testing.T) {
 				},
 				{
 					"$project": bson.M{
-						"value": "$_id",
-						"items": "$items",
-						"field": "data.email",
+						"_id":          0,
+						"value":        "$_id",
+						"items":        "$items",
+						"field":        "category",
+						"hasSubgroups": bson.M{"$literal": true},
+						"aggregates": bson.M{
+							"price": bson.M{
+								"count": bson.M{"$sum": "$items.aggregates.price.count"},
+								"min":   bson.M{"$min": "$items.aggregates.price.min"},
+								"max":   bson.M{"$max": "$items.aggregates.price.max"},
+							},
+						},
+					},
+				},
+			}...)
+
+			gotPipeline, err := ds.getPipeline()
+			if err != nil {
+				t.Fatalf("DataState.getPipeline() error = %v", err)
+			}
+			if !reflect.DeepEqual(gotPipeline, wantPipeline) {
+				t.Errorf("DataState.getPipeline() = %v, want %v", gotPipeline, wantPipeline)
+			}
+		})
+
+		t.Run("Should count the documents of a single group level", func(t *testing.T) {
+			ds := DataState{
+				Aggregates: []AggregateDescriptor{
+					{Aggregate: "count", Field: "price"},
+				},
+				Group: []GroupDescriptor{
+					{Field: "category", Dir: "desc"},
+				},
+			}
+
+			wantProject := bson.M{
+				"$project": bson.M{
+					"_id":          0,
+					"value":        "$_id.category",
+					"items":        "$items",
+					"field":        "category",
+					"hasSubgroups": bson.M{"$literal": false},
+					"aggregates": bson.M{
+						"price": bson.M{
+							"count": bson.M{"$size": "$items"},
+						},
+					},
+				},
+			}
+
+			if gotProject := ds.getProject(); !reflect.DeepEqual(gotProject, wantProject) {
+				t.Errorf("DataState.getProject() = %v, want %v", gotProject, wantProject)
+			}
+		})
+
+		t.Run("Should return Kendo groups without aggregates", func(t *testing.T) {
+			ds := DataState{
+				Group: []GroupDescriptor{
+					{Field: "category", Dir: "asc"},
+					{Field: "brand", Dir: "asc"},
+				},
+			}
+
+			wantProject := bson.M{
+				"$project": bson.M{
+					"_id":          0,
+					"value":        "$_id",
+					"items":        "$items",
+					"field":        "category",
+					"hasSubgroups": bson.M{"$literal": true},
+					"aggregates":   bson.M{"$literal": bson.M{}},
+				},
+			}
+
+			if gotProject := ds.getProject(); !reflect.DeepEqual(gotProject, wantProject) {
+				t.Errorf("DataState.getProject() = %v, want %v", gotProject, wantProject)
+			}
+		})
+
+		t.Run("Should compute the aggregates of the group descriptors", func(t *testing.T) {
+			d, err := NewDataStateFromJSON(strings.NewReader(
+				`{"group":[{"field":"owner","dir":"asc","aggregates":[{"field":"price","aggregate":"sum"}]}]}`))
+			if err != nil {
+				t.Fatalf("NewDataStateFromJSON() error = %v", err)
+			}
+			if err = d.Parse(); err != nil {
+				t.Fatalf("DataState.Parse() error = %v", err)
+			}
+
+			wantPipeline := append(d.getBasePipeline(), []bson.M{
+				{
+					"$group": bson.M{
+						"_id":   bson.M{"owner": "$owner"},
+						"items": bson.M{"$push": "$$ROOT"},
+					},
+				},
+				{
+					"$sort": bson.M{"_id.owner": 1},
+				},
+				{
+					"$project": bson.M{
+						"_id":          0,
+						"value":        "$_id.owner",
+						"items":        "$items",
+						"field":        "owner",
+						"hasSubgroups": bson.M{"$literal": false},
 						"aggregates": bson.M{
-							"commissiondue": bson.M{
-								"average": bson.M{
-									"$avg": "$items.aggregates.commissiondue.average",
+							"price": bson.M{"sum": bson.M{"$sum": "$items.price"}},
+						},
+					},
+				},
+			}...)
+
+			gotPipeline, err := d.getPipeline()
+			if err != nil {
+				t.Fatalf("DataState.getPipeline() error = %v", err)
+			}
+			if !reflect.DeepEqual(gotPipeline, wantPipeline) {
+				t.Errorf("DataState.getPipeline() = %v, want %v", gotPipeline, wantPipeline)
+			}
+		})
+
+		t.Run("Should combine only the aggregates of the subgroups", func(t *testing.T) {
+			ds := DataState{
+				Aggregates: []AggregateDescriptor{
+					{Aggregate: "max", Field: "price"},
+				},
+				Group: []GroupDescriptor{
+					{Field: "category", Dir: "asc", Aggregates: []AggregateDescriptor{{Aggregate: "count", Field: "price"}}},
+					{Field: "brand", Dir: "asc", Aggregates: []AggregateDescriptor{{Aggregate: "max", Field: "price"}}},
+				},
+			}
+
+			wantAggregates := bson.M{
+				"price": bson.M{
+					"max": bson.M{"$max": "$items.aggregates.price.max"},
+					"count": bson.M{
+						"$size": bson.M{
+							"$reduce": bson.M{
+								"input":        "$items.items",
+								"initialValue": []interface{}{},
+								"in": bson.M{
+									"$concatArrays": []interface{}{"$$value", "$$this"},
 								},
-								"sum": bson.M{
-									"$sum": "$items.aggregates.commissiondue.sum",
+							},
+						},
+					},
+				},
+			}
+
+			project := ds.getProject()["$project"].(bson.M)
+			if gotAggregates := project["aggregates"]; !reflect.DeepEqual(gotAggregates, wantAggregates) {
+				t.Errorf("DataState.getProject() aggregates = %v, want %v", gotAggregates, wantAggregates)
+			}
+		})
+
+		t.Run("Should average the documents of all the subgroup levels", func(t *testing.T) {
+			ds := DataState{
+				Aggregates: []AggregateDescriptor{
+					{Aggregate: "average", Field: "price"},
+				},
+				Group: []GroupDescriptor{
+					{Field: "category", Dir: "asc"},
+					{Field: "brand", Dir: "asc"},
+					{Field: "color", Dir: "asc"},
+				},
+			}
+
+			flatten := func(input interface{}) bson.M {
+				return bson.M{
+					"$reduce": bson.M{
+						"input":        input,
+						"initialValue": []interface{}{},
+						"in": bson.M{
+							"$concatArrays": []interface{}{"$$value", "$$this"},
+						},
+					},
+				}
+			}
+			wantAggregates := bson.M{
+				"price": bson.M{
+					"average": bson.M{"$avg": flatten(flatten("$items.items.items.price"))},
+				},
+			}
+
+			project := ds.getProject()["$project"].(bson.M)
+			if gotAggregates := project["aggregates"]; !reflect.DeepEqual(gotAggregates, wantAggregates) {
+				t.Errorf("DataState.getProject() aggregates = %v, want %v", gotAggregates, wantAggregates)
+			}
+		})
+
+		t.Run("Should compute extended and registered aggregates from the documents", func(t *testing.T) {
+			RegisterAggregate("range", func(args ...string) (*Aggregator, error) {
+				return &Aggregator{
+					Expression: func(values interface{}) interface{} {
+						return bson.M{"$subtract": []interface{}{bson.M{"$max": values}, bson.M{"$min": values}}}
+					},
+				}, nil
+			})
+			defer unregisterAggregate("range")
+
+			ds := DataState{
+				Aggregates: []AggregateDescriptor{
+					{Aggregate: "countDistinct", Field: "brand"},
+					{Aggregate: "percentile(90)", Field: "price"},
+					{Aggregate: "stdDevSamp", Field: "price"},
+					{Aggregate: "range", Field: "price"},
+				},
+				Group: []GroupDescriptor{
+					{Field: "category", Dir: "asc"},
+				},
+			}
+
+			wantAggregates := bson.M{
+				"brand": bson.M{
+					"countDistinct": bson.M{"$size": bson.M{"$setUnion": []interface{}{"$items.brand"}}},
+				},
+				"price": bson.M{
+					"percentile(90)": bson.M{
+						"$arrayElemAt": []interface{}{
+							bson.M{
+								"$percentile": bson.M{
+									"input":  "$items.price",
+									"p":      []interface{}{0.9},
+									"method": "approximate",
 								},
 							},
+							0,
 						},
-						"_id": 0,
+					},
+					"stdDevSamp": bson.M{"$stdDevSamp": "$items.price"},
+					"range": bson.M{
+						"$subtract": []interface{}{bson.M{"$max": "$items.price"}, bson.M{"$min": "$items.price"}},
 					},
 				},
 			}
 
-			if gotPipeline := ds.getPipeline(); !reflect.DeepEqual(gotPipeline, wantPipeline) {
+			project := ds.getProject()["$project"].(bson.M)
+			if gotAggregates := project["aggregates"]; !reflect.DeepEqual(gotAggregates, wantAggregates) {
+				t.Errorf("DataState.getProject() aggregates = %v, want %v", gotAggregates, wantAggregates)
+			}
+		})
+
+		t.Run("Should sort the documents before grouping for first and last", func(t *testing.T) {
+			ds := DataState{
+				Aggregates: []AggregateDescriptor{
+					{Aggregate: "first", Field: "price"},
+				},
+				Group: []GroupDescriptor{
+					{Field: "category", Dir: "asc"},
+				},
+				Sort: []SortDescriptor{
+					{Field: "date", Dir: "desc"},
+				},
+			}
+
+			wantPipeline := append(ds.getBasePipeline(), bson.M{
+				"$sort": bson.D{{Name: "date", Value: -1}},
+			})
+			wantPipeline = append(wantPipeline, ds.getGroups()...)
+			wantPipeline = append(wantPipeline, ds.getProject())
+
+			gotPipeline, err := ds.getPipeline()
+			if err != nil {
+				t.Fatalf("DataState.getPipeline() error = %v", err)
+			}
+			if !reflect.DeepEqual(gotPipeline, wantPipeline) {
 				t.Errorf("DataState.getPipeline() = %v, want %v", gotPipeline, wantPipeline)
 			}
 		})
 
+		t.Run("Should compute first and last of the upper groups in the order of the sort", func(t *testing.T) {
+			ds := DataState{
+				Aggregates: []AggregateDescriptor{
+					{Aggregate: "first", Field: "price"},
+					{Aggregate: "last", Field: "price"},
+				},
+				Group: []GroupDescriptor{
+					{Field: "a", Dir: "asc"},
+					{Field: "b", Dir: "asc"},
+				},
+				Sort: []SortDescriptor{
+					{Field: "date", Dir: "desc"},
+				},
+			}
+
+			// subgroups are sorted by their key, their documents are sorted again
+			sorted := bson.M{
+				"$map": bson.M{
+					"input": bson.M{
+						"$sortArray": bson.M{
+							"input":  ds.Aggregates[0].getValues(1, true),
+							"sortBy": bson.D{{Name: "date", Value: -1}},
+						},
+					},
+					"in": "$$this.price",
+				},
+			}
+			wantAggregates := bson.M{
+				"price": bson.M{
+					"first": bson.M{"$arrayElemAt": []interface{}{sorted, 0}},
+					"last":  bson.M{"$arrayElemAt": []interface{}{sorted, -1}},
+				},
+			}
+
+			project := ds.getProject()["$project"].(bson.M)
+			if gotAggregates := project["aggregates"]; !reflect.DeepEqual(gotAggregates, wantAggregates) {
+				t.Errorf("DataState.getProject() aggregates = %v, want %v", gotAggregates, wantAggregates)
+			}
+
+			// the documents of the lowest groups are already in order
+			wantSubgroupAggregates := bson.M{
+				"price": bson.M{
+					"first": bson.M{"$arrayElemAt": []interface{}{"$items.price", 0}},
+					"last":  bson.M{"$arrayElemAt": []interface{}{"$items.price", -1}},
+				},
+			}
+
+			group := ds.getGroup("$_id.a", "b", "b", 0)["$group"].(bson.M)
+			pushed := group["items"].(bson.M)["$push"].(bson.M)
+			if gotAggregates := pushed["aggregates"]; !reflect.DeepEqual(gotAggregates, wantSubgroupAggregates) {
+				t.Errorf("DataState.getGroup() aggregates = %v, want %v", gotAggregates, wantSubgroupAggregates)
+			}
+		})
+
+		t.Run("Should return an AggregateError for unknown aggregates", func(t *testing.T) {
+			ds := DataState{
+				Aggregates: []AggregateDescriptor{
+					{Aggregate: "mode", Field: "price"},
+				},
+			}
+
+			if _, err := ds.getPipeline(); err == nil {
+				t.Errorf("DataState.getPipeline() error = nil, want AggregateError")
+			}
+		})
+
 		t.Run("Should return ascending sort", func(t *testing.T) {
 			ds := DataState{
 				Sort: []SortDescriptor{
@@ -204,13 +629,17 @@ func TestDataState(t *testing.T) {
 					},
 				},
 				{
-					"$sort": bson.M{
-						"name": 1,
+					"$sort": bson.D{
+						{Name: "name", Value: 1},
 					},
 				},
 			}
 
-			if gotPipeline := ds.getPipeline(); !reflect.DeepEqual(gotPipeline, wantPipeline) {
+			gotPipeline, err := ds.getPipeline()
+			if err != nil {
+				t.Fatalf("DataState.getPipeline() error = %v", err)
+			}
+			if !reflect.DeepEqual(gotPipeline, wantPipeline) {
 				t.Errorf("DataState.getPipeline() = %v, want %v", gotPipeline, wantPipeline)
 			}
 		})
@@ -236,13 +665,17 @@ func TestDataState(t *testing.T) {
 					},
 				},
 				{
-					"$sort": bson.M{
-						"name": -1,
+					"$sort": bson.D{
+						{Name: "name", Value: -1},
 					},
 				},
 			}
 
-			if gotPipeline := ds.getPipeline(); !reflect.DeepEqual(gotPipeline, wantPipeline) {
+			gotPipeline, err := ds.getPipeline()
+			if err != nil {
+				t.Fatalf("DataState.getPipeline() error = %v", err)
+			}
+			if !reflect.DeepEqual(gotPipeline, wantPipeline) {
 				t.Errorf("DataState.getPipeline() = %v, want %v", gotPipeline, wantPipeline)
 			}
 		})
@@ -260,8 +693,8 @@ func TestDataState(t *testing.T) {
 			}
 
 			wantSortFields := bson.M{
-				"$sort": bson.M{
-					"name": 1,
+				"$sort": bson.D{
+					{Name: "name", Value: 1},
 				},
 			}
 
@@ -281,8 +714,8 @@ func TestDataState(t *testing.T) {
 			}
 
 			wantSortFields := bson.M{
-				"$sort": bson.M{
-					"name": -1,
+				"$sort": bson.D{
+					{Name: "name", Value: -1},
 				},
 			}
 
@@ -290,49 +723,66 @@ func TestDataState(t *testing.T) {
 				t.Errorf("DataState.getSortFields() = %v, want %v", gotSortFields, wantSortFields)
 			}
 		})
-	})
 
-	t.Run("getPaging", func(t *testing.T) {
-		t.Run("Should return skip and limit equal to requested page", func(t *testing.T) {
+		t.Run("Should keep the order of multiple sorts", func(t *testing.T) {
 			ds := DataState{
-				Page:     3,
-				PageSize: 10,
+				Sort: []SortDescriptor{
+					{Dir: "desc", Field: "b"},
+					{Dir: "asc", Field: "a"},
+					{Dir: "desc", Field: "c"},
+				},
 			}
 
-			wantPaging := []bson.M{
-				{
-					"$skip": 20,
-				},
-				{
-					"$limit": 10,
+			wantSortFields := bson.M{
+				"$sort": bson.D{
+					{Name: "b", Value: -1},
+					{Name: "a", Value: 1},
+					{Name: "c", Value: -1},
 				},
 			}
 
-			if gotPaging := ds.getPaging(); !reflect.DeepEqual(gotPaging, wantPaging) {
-				t.Errorf("DataState.getPaging() = %v, want %v", gotPaging, wantPaging)
+			if gotSortFields := ds.getSortFields(); !reflect.DeepEqual(gotSortFields, wantSortFields) {
+				t.Errorf("DataState.getSortFields() = %v, want %v", gotSortFields, wantSortFields)
 			}
 		})
-	})
 
-	t.Run("getTotalPipeline", func(t *testing.T) {
-		t.Run("Should return the base pipeline and $count if there is no filter or lookups", func(t *testing.T) {
-			ds := DataState{}
+		t.Run("Should sort the documents before grouping instead of the groups", func(t *testing.T) {
+			ds := DataState{
+				Group: []GroupDescriptor{
+					{Field: "category", Dir: "asc"},
+				},
+				Sort: []SortDescriptor{
+					{Field: "name", Dir: "asc"},
+				},
+			}
 
-			wantTotalPipeline := append(ds.getBasePipeline(), bson.M{
-				"$count": "total",
+			if gotSortFields := ds.getSortFields(); gotSortFields != nil {
+				t.Errorf("DataState.getSortFields() = %v, want nil", gotSortFields)
+			}
+
+			wantPipeline := append(ds.getBasePipeline(), bson.M{
+				"$sort": bson.D{{Name: "name", Value: 1}},
 			})
+			wantPipeline = append(wantPipeline, ds.getGroups()...)
+			wantPipeline = append(wantPipeline, ds.getProject())
 
-			if gotTotalPipeline := ds.getTotalPipeline(); !reflect.DeepEqual(gotTotalPipeline, wantTotalPipeline) {
-				t.Errorf("DataState.getTotalPipeline() = %v, want %v", gotTotalPipeline, wantTotalPipeline)
+			gotPipeline, err := ds.getPipeline()
+			if err != nil {
+				t.Fatalf("DataState.getPipeline() error = %v", err)
+			}
+			if !reflect.DeepEqual(gotPipeline, wantPipeline) {
+				t.Errorf("DataState.getPipeline() = %v, want %v", gotPipeline, wantPipeline)
 			}
 		})
+	})
 
-		t.Run("Should return pipeline with filters if present", func(t *testing.T) {
+	t.Run("getFilter", func(t *testing.T) {
+		t.Run("Should return the leaf filter if there is a single filter", func(t *testing.T) {
 			ds := DataState{
 				Filter: CompositeFilterDescriptor{
 					Logic: "and",
-					Filters: []FilterDescriptor{
-						{
+					Filters: []Filter{
+						&FilterDescriptor{
 							Field:    "name",
 							Operator: "eq",
 							Value:    "John",
@@ -341,23 +791,955 @@ func TestDataState(t *testing.T) {
 				},
 			}
 
-			wantTotalPipeline := append(ds.getBasePipeline(), []bson.M{
-				{"$match": ds.getFilter()},
-				{"$count": "total"},
-			}...)
+			wantFilter := bson.M{
+				"name": "John",
+			}
 
-			if gotTotalPipeline := ds.getTotalPipeline(); !reflect.DeepEqual(gotTotalPipeline, wantTotalPipeline) {
-				t.Errorf("DataState.getTotalPipeline() = %v, want %v", gotTotalPipeline, wantTotalPipeline)
+			gotFilter, err := ds.getFilter()
+			if err != nil {
+				t.Fatalf("DataState.getFilter() error = %v", err)
+			}
+			if !reflect.DeepEqual(gotFilter, wantFilter) {
+				t.Errorf("DataState.getFilter() = %v, want %v", gotFilter, wantFilter)
 			}
 		})
 
-		t.Run("Should lookup if a filter is done on the lookup field", func(t *testing.T) {
+		t.Run("Should keep filters on the same field in $and", func(t *testing.T) {
 			ds := DataState{
 				Filter: CompositeFilterDescriptor{
 					Logic: "and",
-					Filters: []FilterDescriptor{
-						{
-							Field:    "owner.name",
+					Filters: []Filter{
+						&FilterDescriptor{
+							Field:    "price",
+							Operator: "gt",
+							Value:    10,
+						},
+						&FilterDescriptor{
+							Field:    "price",
+							Operator: "lt",
+							Value:    50,
+						},
+					},
+				},
+			}
+
+			wantFilter := bson.M{
+				"$and": []bson.M{
+					{"price": bson.M{"$gt": 10}},
+					{"price": bson.M{"$lt": 50}},
+				},
+			}
+
+			gotFilter, err := ds.getFilter()
+			if err != nil {
+				t.Fatalf("DataState.getFilter() error = %v", err)
+			}
+			if !reflect.DeepEqual(gotFilter, wantFilter) {
+				t.Errorf("DataState.getFilter() = %v, want %v", gotFilter, wantFilter)
+			}
+		})
+
+		t.Run("Should compile nested composites to $or and $and", func(t *testing.T) {
+			ds := DataState{
+				Filter: CompositeFilterDescriptor{
+					Logic: "or",
+					Filters: []Filter{
+						&FilterDescriptor{
+							Field:    "status",
+							Operator: "eq",
+							Value:    "open",
+						},
+						&CompositeFilterDescriptor{
+							Logic: "and",
+							Filters: []Filter{
+								&FilterDescriptor{
+									Field:    "owner",
+									Operator: "eq",
+									Value:    "bob",
+								},
+								&FilterDescriptor{
+									Field:    "due",
+									Operator: "lt",
+									Value:    5,
+								},
+							},
+						},
+					},
+				},
+			}
+
+			wantFilter := bson.M{
+				"$or": []bson.M{
+					{"status": "open"},
+					{
+						"$and": []bson.M{
+							{"owner": "bob"},
+							{"due": bson.M{"$lt": 5}},
+						},
+					},
+				},
+			}
+
+			gotFilter, err := ds.getFilter()
+			if err != nil {
+				t.Fatalf("DataState.getFilter() error = %v", err)
+			}
+			if !reflect.DeepEqual(gotFilter, wantFilter) {
+				t.Errorf("DataState.getFilter() = %v, want %v", gotFilter, wantFilter)
+			}
+		})
+	})
+
+	t.Run("getFilter lists", func(t *testing.T) {
+		t.Run("Should collapse eq filters on the same field in $or to $in", func(t *testing.T) {
+			ds := DataState{
+				Filter: CompositeFilterDescriptor{
+					Logic: "and",
+					Filters: []Filter{
+						&CompositeFilterDescriptor{
+							Logic: "or",
+							Filters: []Filter{
+								&FilterDescriptor{Field: "status", Operator: "eq", Value: "open"},
+								&FilterDescriptor{Field: "status", Operator: "eq", Value: "Closed", IgnoreCase: true},
+								&FilterDescriptor{Field: "status", Operator: "eq", Value: nil},
+							},
+						},
+					},
+				},
+			}
+
+			wantFilter := bson.M{
+				"status": bson.M{"$in": []interface{}{"open", bson.RegEx{Pattern: "^Closed$", Options: "i"}, nil}},
+			}
+
+			gotFilter, err := ds.getFilter()
+			if err != nil {
+				t.Fatalf("DataState.getFilter() error = %v", err)
+			}
+			if !reflect.DeepEqual(gotFilter, wantFilter) {
+				t.Errorf("DataState.getFilter() = %v, want %v", gotFilter, wantFilter)
+			}
+		})
+
+		t.Run("Should collapse neq filters on the same field in $and to $nin", func(t *testing.T) {
+			ds := DataState{
+				Filter: CompositeFilterDescriptor{
+					Logic: "and",
+					Filters: []Filter{
+						&FilterDescriptor{Field: "status", Operator: "neq", Value: "open"},
+						&FilterDescriptor{Field: "status", Operator: "ne", Value: "closed"},
+					},
+				},
+			}
+
+			wantFilter := bson.M{
+				"status": bson.M{"$nin": []interface{}{"open", "closed"}},
+			}
+
+			gotFilter, err := ds.getFilter()
+			if err != nil {
+				t.Fatalf("DataState.getFilter() error = %v", err)
+			}
+			if !reflect.DeepEqual(gotFilter, wantFilter) {
+				t.Errorf("DataState.getFilter() = %v, want %v", gotFilter, wantFilter)
+			}
+		})
+
+		t.Run("Should not collapse filters on different fields or operators", func(t *testing.T) {
+			ds := DataState{
+				Filter: CompositeFilterDescriptor{
+					Logic: "or",
+					Filters: []Filter{
+						&FilterDescriptor{Field: "status", Operator: "eq", Value: "open"},
+						&FilterDescriptor{Field: "owner", Operator: "eq", Value: "bob"},
+					},
+				},
+			}
+
+			wantFilter := bson.M{
+				"$or": []bson.M{
+					{"status": "open"},
+					{"owner": "bob"},
+				},
+			}
+
+			gotFilter, err := ds.getFilter()
+			if err != nil {
+				t.Fatalf("DataState.getFilter() error = %v", err)
+			}
+			if !reflect.DeepEqual(gotFilter, wantFilter) {
+				t.Errorf("DataState.getFilter() = %v, want %v", gotFilter, wantFilter)
+			}
+		})
+	})
+
+	t.Run("getFilter operators", func(t *testing.T) {
+		t.Run("Should use registered operators", func(t *testing.T) {
+			RegisterOperator("hastag", func(d *DataState, f *FilterDescriptor) (bson.M, error) {
+				return bson.M{f.Field: bson.M{"$elemMatch": bson.M{"name": f.Value}}}, nil
+			})
+			defer unregisterOperator("hastag")
+
+			ds := DataState{
+				Filter: CompositeFilterDescriptor{
+					Filters: []Filter{
+						&FilterDescriptor{Field: "tags", Operator: "hastag", Value: "go"},
+					},
+				},
+			}
+
+			wantFilter := bson.M{"tags": bson.M{"$elemMatch": bson.M{"name": "go"}}}
+
+			gotFilter, err := ds.getFilter()
+			if err != nil {
+				t.Fatalf("DataState.getFilter() error = %v", err)
+			}
+			if !reflect.DeepEqual(gotFilter, wantFilter) {
+				t.Errorf("DataState.getFilter() = %v, want %v", gotFilter, wantFilter)
+			}
+		})
+
+		t.Run("Should match values that are not strings as text in patterns", func(t *testing.T) {
+			ds := DataState{
+				Filter: CompositeFilterDescriptor{
+					Logic: "and",
+					Filters: []Filter{
+						&FilterDescriptor{Field: "name", Operator: "contains", Value: int64(42), IgnoreCase: true},
+						&FilterDescriptor{Field: "code", Operator: "doesnotstartwith", Value: 1.5},
+					},
+				},
+			}
+
+			wantFilter := bson.M{
+				"$and": []bson.M{
+					{"name": bson.M{"$regex": "42", "$options": "i"}},
+					{"code": bson.M{"$not": bson.RegEx{Pattern: `^1\.5`}}},
+				},
+			}
+
+			gotFilter, err := ds.getFilter()
+			if err != nil {
+				t.Fatalf("DataState.getFilter() error = %v", err)
+			}
+			if !reflect.DeepEqual(gotFilter, wantFilter) {
+				t.Errorf("DataState.getFilter() = %v, want %v", gotFilter, wantFilter)
+			}
+		})
+
+		t.Run("Should override built-in operators", func(t *testing.T) {
+			eq, _ := getOperator("eq")
+			RegisterOperator("eq", func(d *DataState, f *FilterDescriptor) (bson.M, error) {
+				return bson.M{f.Field: bson.M{"$eq": f.Value}}, nil
+			})
+			defer func() {
+				unregisterOperator("eq")
+				operatorsMutex.Lock()
+				operators["eq"] = eq
+				operatorsMutex.Unlock()
+			}()
+
+			ds := DataState{
+				Filter: CompositeFilterDescriptor{
+					Logic: "or",
+					Filters: []Filter{
+						&FilterDescriptor{Field: "status", Operator: "eq", Value: "open"},
+						&FilterDescriptor{Field: "status", Operator: "eq", Value: "closed"},
+					},
+				},
+			}
+
+			wantFilter := bson.M{
+				"$or": []bson.M{
+					{"status": bson.M{"$eq": "open"}},
+					{"status": bson.M{"$eq": "closed"}},
+				},
+			}
+
+			gotFilter, err := ds.getFilter()
+			if err != nil {
+				t.Fatalf("DataState.getFilter() error = %v", err)
+			}
+			if !reflect.DeepEqual(gotFilter, wantFilter) {
+				t.Errorf("DataState.getFilter() = %v, want %v", gotFilter, wantFilter)
+			}
+		})
+
+		t.Run("Should return the error of an operator", func(t *testing.T) {
+			wantErr := errors.New("invalid point")
+			RegisterOperator("near", func(d *DataState, f *FilterDescriptor) (bson.M, error) {
+				return nil, wantErr
+			})
+			defer unregisterOperator("near")
+
+			ds := DataState{
+				Filter: CompositeFilterDescriptor{
+					Filters: []Filter{
+						&FilterDescriptor{Field: "location", Operator: "near", Value: "x"},
+					},
+				},
+			}
+
+			if _, err := ds.getPipeline(); err != wantErr {
+				t.Errorf("DataState.getPipeline() error = %v, want %v", err, wantErr)
+			}
+		})
+
+		t.Run("Should return an UnknownOperatorError", func(t *testing.T) {
+			ds := DataState{
+				Filter: CompositeFilterDescriptor{
+					Filters: []Filter{
+						&FilterDescriptor{Field: "name", Operator: "eq", Value: "a"},
+						&FilterDescriptor{Field: "name", Operator: "like", Value: "a"},
+					},
+				},
+			}
+
+			wantErr := UnknownOperatorError{Field: "name", Operator: "like"}
+
+			_, err := ds.getTotalPipeline()
+			if gotErr, ok := err.(*UnknownOperatorError); !ok || *gotErr != wantErr {
+				t.Errorf("DataState.getTotalPipeline() error = %v, want %v", err, &wantErr)
+			}
+			if err := ds.parse(); err == nil || err.Error() != wantErr.Error() {
+				t.Errorf("DataState.parse() error = %v, want %v", err, &wantErr)
+			}
+		})
+	})
+
+	t.Run("getFilter null semantics", func(t *testing.T) {
+		nullType := bson.M{"$type": "null"}
+		tests := []struct {
+			operator   string
+			semantics  NullSemantics
+			wantFilter bson.M
+		}{
+			{"isnull", NullSemantics{}, bson.M{"name": nil}},
+			{"isnull", NullSemantics{StrictNull: true}, bson.M{"name": nullType}},
+			{"isnotnull", NullSemantics{}, bson.M{"name": bson.M{"$ne": nil}}},
+			{"isnotnull", NullSemantics{StrictNull: true}, bson.M{"name": bson.M{"$not": nullType}}},
+			{"isempty", NullSemantics{}, bson.M{"name": ""}},
+			{"isempty", NullSemantics{EmptyArrays: true}, bson.M{"name": bson.M{"$in": []interface{}{"", []interface{}{}}}}},
+			{"isnotempty", NullSemantics{}, bson.M{"name": bson.M{"$ne": ""}}},
+			{"isnotempty", NullSemantics{EmptyArrays: true}, bson.M{"name": bson.M{"$nin": []interface{}{"", []interface{}{}}}}},
+			{"isnullorempty", NullSemantics{}, bson.M{"name": bson.M{"$in": []interface{}{nil, ""}}}},
+			{"isnullorempty", NullSemantics{StrictNull: true, EmptyArrays: true}, bson.M{
+				"$or": []bson.M{
+					{"name": nullType},
+					{"name": bson.M{"$in": []interface{}{"", []interface{}{}}}},
+				},
+			}},
+			{"isnotnullorempty", NullSemantics{}, bson.M{"name": bson.M{"$nin": []interface{}{nil, ""}}}},
+			{"isnotnullorempty", NullSemantics{StrictNull: true}, bson.M{"name": bson.M{"$not": nullType, "$nin": []interface{}{""}}}},
+		}
+
+		for _, tt := range tests {
+			ds := DataState{
+				Filter: CompositeFilterDescriptor{
+					Filters: []Filter{
+						&FilterDescriptor{Field: "name", Operator: tt.operator},
+					},
+				},
+			}
+			ds.WithNullSemantics(tt.semantics)
+
+			gotFilter, err := ds.getFilter()
+			if err != nil {
+				t.Fatalf("DataState.getFilter() error = %v", err)
+			}
+			if !reflect.DeepEqual(gotFilter, tt.wantFilter) {
+				t.Errorf("DataState.getFilter(%s, %+v) = %v, want %v", tt.operator, tt.semantics, gotFilter, tt.wantFilter)
+			}
+		}
+	})
+
+	t.Run("getFilter arrays", func(t *testing.T) {
+		sub := &CompositeFilterDescriptor{
+			Logic: "and",
+			Filters: []Filter{
+				&FilterDescriptor{Field: "sku", Operator: "eq", Value: "X"},
+				&FilterDescriptor{Field: "qty", Operator: "gt", Value: int64(5)},
+			},
+		}
+		subFilter := bson.M{
+			"$and": []bson.M{
+				{"sku": "X"},
+				{"qty": bson.M{"$gt": int64(5)}},
+			},
+		}
+
+		tests := []struct {
+			name       string
+			filter     FilterDescriptor
+			wantFilter bson.M
+		}{
+			{
+				name:       "Should match an element with the sub-filter",
+				filter:     FilterDescriptor{Field: "items", Operator: "any", Value: sub},
+				wantFilter: bson.M{"items": bson.M{"$elemMatch": subFilter}},
+			},
+			{
+				name:   "Should match all elements with the sub-filter",
+				filter: FilterDescriptor{Field: "items", Operator: "all", Value: sub},
+				wantFilter: bson.M{"items": bson.M{
+					"$not": bson.M{"$elemMatch": bson.M{"$nor": []bson.M{subFilter}}},
+				}},
+			},
+			{
+				name:       "Should match any of the values",
+				filter:     FilterDescriptor{Field: "tags", Operator: "any", Value: []interface{}{"go", "mongo"}},
+				wantFilter: bson.M{"tags": bson.M{"$in": []interface{}{"go", "mongo"}}},
+			},
+			{
+				name:       "Should match all of the values",
+				filter:     FilterDescriptor{Field: "tags", Operator: "all", Value: []interface{}{"go", "mongo"}},
+				wantFilter: bson.M{"tags": bson.M{"$all": []interface{}{"go", "mongo"}}},
+			},
+			{
+				name:       "Should match the size of the array",
+				filter:     FilterDescriptor{Field: "tags", Operator: "size", Value: int64(2)},
+				wantFilter: bson.M{"tags": bson.M{"$size": int64(2)}},
+			},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				filter := tt.filter
+				ds := DataState{
+					Filter: CompositeFilterDescriptor{
+						Filters: []Filter{&filter},
+					},
+				}
+
+				gotFilter, err := ds.getFilter()
+				if err != nil {
+					t.Fatalf("DataState.getFilter() error = %v", err)
+				}
+				if !reflect.DeepEqual(gotFilter, tt.wantFilter) {
+					t.Errorf("DataState.getFilter() = %v, want %v", gotFilter, tt.wantFilter)
+				}
+			})
+		}
+	})
+
+	t.Run("getFilter date only", func(t *testing.T) {
+		paris, err := time.LoadLocation("Europe/Paris")
+		if err != nil {
+			t.Skip("Europe/Paris timezone not available")
+		}
+		start := time.Date(2024, 3, 1, 0, 0, 0, 0, paris)
+		end := time.Date(2024, 3, 2, 0, 0, 0, 0, paris)
+		due := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC) // 11:00 in Paris
+
+		tests := []struct {
+			operator   string
+			wantFilter bson.M
+		}{
+			{"eq", bson.M{"due": bson.M{"$gte": start, "$lt": end}}},
+			{"neq", bson.M{"due": bson.M{"$not": bson.M{"$gte": start, "$lt": end}}}},
+			{"lt", bson.M{"due": bson.M{"$lt": start}}},
+			{"lte", bson.M{"due": bson.M{"$lt": end}}},
+			{"gt", bson.M{"due": bson.M{"$gte": end}}},
+			{"gte", bson.M{"due": bson.M{"$gte": start}}},
+		}
+
+		for _, tt := range tests {
+			ds := DataState{
+				Filter: CompositeFilterDescriptor{
+					Filters: []Filter{
+						&FilterDescriptor{Field: "due", Operator: tt.operator, Value: due},
+					},
+				},
+			}
+			ds.WithSchema(map[string]FieldType{"due": FieldDateOnly})
+			ds.WithTimezone(paris)
+
+			gotFilter, err := ds.getFilter()
+			if err != nil {
+				t.Fatalf("DataState.getFilter() error = %v", err)
+			}
+			if !reflect.DeepEqual(gotFilter, tt.wantFilter) {
+				t.Errorf("DataState.getFilter(%s) = %v, want %v", tt.operator, gotFilter, tt.wantFilter)
+			}
+		}
+
+		t.Run("Should compare instants of date fields", func(t *testing.T) {
+			ds := DataState{
+				Filter: CompositeFilterDescriptor{
+					Filters: []Filter{
+						&FilterDescriptor{Field: "due", Operator: "eq", Value: due},
+					},
+				},
+			}
+			ds.WithSchema(map[string]FieldType{"due": FieldDate})
+			ds.WithTimezone(paris)
+
+			wantFilter := bson.M{"due": due}
+
+			gotFilter, err := ds.getFilter()
+			if err != nil {
+				t.Fatalf("DataState.getFilter() error = %v", err)
+			}
+			if !reflect.DeepEqual(gotFilter, wantFilter) {
+				t.Errorf("DataState.getFilter() = %v, want %v", gotFilter, wantFilter)
+			}
+		})
+
+		t.Run("Should use the schema of the path of sub-filter fields", func(t *testing.T) {
+			ds := DataState{
+				Filter: CompositeFilterDescriptor{
+					Filters: []Filter{
+						&FilterDescriptor{Field: "items", Operator: "any", Value: &FilterDescriptor{Field: "due", Operator: "eq", Value: due}},
+						&FilterDescriptor{Field: "lines", Operator: "all", Value: &FilterDescriptor{Field: "due", Operator: "eq", Value: due}},
+					},
+				},
+			}
+			ds.WithSchema(map[string]FieldType{"due": FieldDateOnly, "items.due": FieldDate, "lines.due": FieldDateOnly})
+			ds.WithTimezone(paris)
+
+			wantFilter := bson.M{
+				"$and": []bson.M{
+					{"items": bson.M{"$elemMatch": bson.M{"due": due}}},
+					{"lines": bson.M{"$not": bson.M{"$elemMatch": bson.M{"$nor": []bson.M{
+						{"due": bson.M{"$gte": start, "$lt": end}},
+					}}}}},
+				},
+			}
+
+			gotFilter, err := ds.getFilter()
+			if err != nil {
+				t.Fatalf("DataState.getFilter() error = %v", err)
+			}
+			if !reflect.DeepEqual(gotFilter, wantFilter) {
+				t.Errorf("DataState.getFilter() = %v, want %v", gotFilter, wantFilter)
+			}
+		})
+	})
+
+	t.Run("getFilter search", func(t *testing.T) {
+		t.Run("Should combine the search term on the search fields with the filter", func(t *testing.T) {
+			ds := DataState{
+				Filter: CompositeFilterDescriptor{
+					Filters: []Filter{
+						&FilterDescriptor{Field: "status", Operator: "eq", Value: "open"},
+					},
+				},
+				Search: " a.b ",
+			}
+			ds.WithSearchFields([]string{"name", "vendor.name"})
+
+			wantFilter := bson.M{
+				"$and": []bson.M{
+					{"status": "open"},
+					{
+						"$or": []bson.M{
+							{"name": bson.M{"$regex": `a\.b`, "$options": "i"}},
+							{"vendor.name": bson.M{"$regex": `a\.b`, "$options": "i"}},
+						},
+					},
+				},
+			}
+
+			gotFilter, err := ds.getFilter()
+			if err != nil {
+				t.Fatalf("DataState.getFilter() error = %v", err)
+			}
+			if !reflect.DeepEqual(gotFilter, wantFilter) {
+				t.Errorf("DataState.getFilter() = %v, want %v", gotFilter, wantFilter)
+			}
+		})
+
+		t.Run("Should match the search term without filter", func(t *testing.T) {
+			ds := DataState{
+				Search: "bob",
+				Lookup: []LookupDescriptor{
+					{From: "vendors", LocalField: "vendorId", ForeignField: "_id", As: "vendor"},
+				},
+			}
+			ds.WithSearchFields([]string{"vendor.name"})
+
+			wantTotalPipeline := append(ds.getBasePipeline(), []bson.M{
+				{
+					"$lookup": bson.M{
+						"from":         "vendors",
+						"localField":   "vendorId",
+						"foreignField": "_id",
+						"as":           "vendor",
+					},
+				},
+				{"$match": bson.M{"vendor.name": bson.M{"$regex": "bob", "$options": "i"}}},
+				{"$count": "total"},
+			}...)
+
+			gotTotalPipeline, err := ds.getTotalPipeline()
+			if err != nil {
+				t.Fatalf("DataState.getTotalPipeline() error = %v", err)
+			}
+			if !reflect.DeepEqual(gotTotalPipeline, wantTotalPipeline) {
+				t.Errorf("DataState.getTotalPipeline() = %v, want %v", gotTotalPipeline, wantTotalPipeline)
+			}
+		})
+
+		t.Run("Should ignore the search term without search fields", func(t *testing.T) {
+			ds := DataState{
+				Search: "bob",
+			}
+
+			gotPipeline, err := ds.getPipeline()
+			if err != nil {
+				t.Fatalf("DataState.getPipeline() error = %v", err)
+			}
+			if wantPipeline := ds.getBasePipeline(); !reflect.DeepEqual(gotPipeline, wantPipeline) {
+				t.Errorf("DataState.getPipeline() = %v, want %v", gotPipeline, wantPipeline)
+			}
+		})
+
+		t.Run("Should match the search term with the text index first", func(t *testing.T) {
+			ds := DataState{
+				Filter: CompositeFilterDescriptor{
+					Filters: []Filter{
+						&FilterDescriptor{Field: "status", Operator: "eq", Value: "open"},
+					},
+				},
+				Search: "blue car",
+			}
+			ds.WithSearchFields([]string{"name"})
+			ds.WithTextSearch(true)
+
+			wantPipeline := []bson.M{
+				{"$match": bson.M{"$text": bson.M{"$search": "blue car"}}},
+				{"$addFields": bson.M{"id": "$_id"}},
+				{"$project": bson.M{"_id": 0}},
+				{"$match": bson.M{"status": "open"}},
+			}
+
+			gotPipeline, err := ds.getPipeline()
+			if err != nil {
+				t.Fatalf("DataState.getPipeline() error = %v", err)
+			}
+			if !reflect.DeepEqual(gotPipeline, wantPipeline) {
+				t.Errorf("DataState.getPipeline() = %v, want %v", gotPipeline, wantPipeline)
+			}
+		})
+	})
+
+	t.Run("getFilter ignoreCase", func(t *testing.T) {
+		tests := []struct {
+			name       string
+			filter     FilterDescriptor
+			collation  *mgo.Collation
+			wantFilter bson.M
+		}{
+			{
+				name:       "Should match eq exactly",
+				filter:     FilterDescriptor{Field: "name", Operator: "eq", Value: "Jo.hn"},
+				wantFilter: bson.M{"name": "Jo.hn"},
+			},
+			{
+				name:       "Should match eq ignoring case with an anchored regex",
+				filter:     FilterDescriptor{Field: "name", Operator: "eq", Value: "Jo.hn", IgnoreCase: true},
+				wantFilter: bson.M{"name": bson.M{"$regex": `^Jo\.hn$`, "$options": "i"}},
+			},
+			{
+				name:       "Should match eq ignoring case with the collation",
+				filter:     FilterDescriptor{Field: "name", Operator: "eq", Value: "John", IgnoreCase: true},
+				collation:  &mgo.Collation{Locale: "en", Strength: 2},
+				wantFilter: bson.M{"name": "John"},
+			},
+			{
+				name:       "Should ignore case only for strings",
+				filter:     FilterDescriptor{Field: "age", Operator: "eq", Value: int64(5), IgnoreCase: true},
+				wantFilter: bson.M{"age": int64(5)},
+			},
+			{
+				name:       "Should match neq exactly",
+				filter:     FilterDescriptor{Field: "name", Operator: "neq", Value: "John"},
+				wantFilter: bson.M{"name": bson.M{"$ne": "John"}},
+			},
+			{
+				name:       "Should match neq ignoring case",
+				filter:     FilterDescriptor{Field: "name", Operator: "neq", Value: "John", IgnoreCase: true},
+				wantFilter: bson.M{"name": bson.M{"$not": bson.RegEx{Pattern: "^John$", Options: "i"}}},
+			},
+			{
+				name:       "Should match startswith with case",
+				filter:     FilterDescriptor{Field: "name", Operator: "startswith", Value: "Jo"},
+				wantFilter: bson.M{"name": bson.M{"$regex": "^Jo"}},
+			},
+			{
+				name:       "Should match endswith ignoring case",
+				filter:     FilterDescriptor{Field: "name", Operator: "endswith", Value: "hn", IgnoreCase: true},
+				wantFilter: bson.M{"name": bson.M{"$regex": "hn$", "$options": "i"}},
+			},
+			{
+				name:       "Should match contains with case",
+				filter:     FilterDescriptor{Field: "name", Operator: "contains", Value: "oh"},
+				wantFilter: bson.M{"name": bson.M{"$regex": "oh"}},
+			},
+			{
+				name:       "Should not contain with case",
+				filter:     FilterDescriptor{Field: "name", Operator: "doesnotcontain", Value: "o(h"},
+				wantFilter: bson.M{"name": bson.M{"$not": bson.RegEx{Pattern: `o\(h`}}},
+			},
+			{
+				name:       "Should not contain ignoring case",
+				filter:     FilterDescriptor{Field: "name", Operator: "doesnotcontain", Value: "oh", IgnoreCase: true},
+				wantFilter: bson.M{"name": bson.M{"$not": bson.RegEx{Pattern: "oh", Options: "i"}}},
+			},
+			{
+				name:       "Should not start with",
+				filter:     FilterDescriptor{Field: "name", Operator: "doesnotstartwith", Value: "Jo", IgnoreCase: true},
+				wantFilter: bson.M{"name": bson.M{"$not": bson.RegEx{Pattern: "^Jo", Options: "i"}}},
+			},
+			{
+				name:       "Should not end with",
+				filter:     FilterDescriptor{Field: "name", Operator: "doesnotendwith", Value: "n$"},
+				wantFilter: bson.M{"name": bson.M{"$not": bson.RegEx{Pattern: `n\$$`}}},
+			},
+			{
+				name:       "Should match a list with case",
+				filter:     FilterDescriptor{Field: "status", Operator: "in", Value: []interface{}{"open", int64(2)}},
+				wantFilter: bson.M{"status": bson.M{"$in": []interface{}{"open", int64(2)}}},
+			},
+			{
+				name:       "Should match a list ignoring case",
+				filter:     FilterDescriptor{Field: "status", Operator: "in", Value: []interface{}{"a.b", int64(2)}, IgnoreCase: true},
+				wantFilter: bson.M{"status": bson.M{"$in": []interface{}{bson.RegEx{Pattern: `^a\.b$`, Options: "i"}, int64(2)}}},
+			},
+			{
+				name:       "Should not match a list",
+				filter:     FilterDescriptor{Field: "status", Operator: "notin", Value: []string{"open", "closed"}},
+				wantFilter: bson.M{"status": bson.M{"$nin": []interface{}{"open", "closed"}}},
+			},
+			{
+				name:       "Should match a single value as a list",
+				filter:     FilterDescriptor{Field: "status", Operator: "in", Value: "open"},
+				wantFilter: bson.M{"status": bson.M{"$in": []interface{}{"open"}}},
+			},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				filter := tt.filter
+				ds := DataState{
+					Filter: CompositeFilterDescriptor{
+						Filters: []Filter{&filter},
+					},
+				}
+				ds.WithCollation(tt.collation)
+
+				gotFilter, err := ds.getFilter()
+				if err != nil {
+					t.Fatalf("DataState.getFilter() error = %v", err)
+				}
+				if !reflect.DeepEqual(gotFilter, tt.wantFilter) {
+					t.Errorf("DataState.getFilter() = %v, want %v", gotFilter, tt.wantFilter)
+				}
+			})
+		}
+	})
+
+	t.Run("getSortFields tiebreaker", func(t *testing.T) {
+		t.Run("Should append the tiebreaker to the sort", func(t *testing.T) {
+			ds := DataState{
+				Sort: []SortDescriptor{
+					{Dir: "desc", Field: "name"},
+				},
+			}
+			ds.WithTiebreaker("id")
+
+			wantSortFields := bson.M{
+				"$sort": bson.D{
+					{Name: "name", Value: -1},
+					{Name: "id", Value: 1},
+				},
+			}
+
+			if gotSortFields := ds.getSortFields(); !reflect.DeepEqual(gotSortFields, wantSortFields) {
+				t.Errorf("DataState.getSortFields() = %v, want %v", gotSortFields, wantSortFields)
+			}
+		})
+
+		t.Run("Should sort on the tiebreaker if there is no sort", func(t *testing.T) {
+			ds := DataState{}
+			ds.WithTiebreaker("id")
+
+			wantSortFields := bson.M{
+				"$sort": bson.D{
+					{Name: "id", Value: 1},
+				},
+			}
+
+			if gotSortFields := ds.getSortFields(); !reflect.DeepEqual(gotSortFields, wantSortFields) {
+				t.Errorf("DataState.getSortFields() = %v, want %v", gotSortFields, wantSortFields)
+			}
+		})
+
+		t.Run("Should not append the tiebreaker if already sorted on", func(t *testing.T) {
+			ds := DataState{
+				Sort: []SortDescriptor{
+					{Dir: "desc", Field: "id"},
+				},
+			}
+			ds.WithTiebreaker("id")
+
+			wantSortFields := bson.M{
+				"$sort": bson.D{
+					{Name: "id", Value: -1},
+				},
+			}
+
+			if gotSortFields := ds.getSortFields(); !reflect.DeepEqual(gotSortFields, wantSortFields) {
+				t.Errorf("DataState.getSortFields() = %v, want %v", gotSortFields, wantSortFields)
+			}
+		})
+
+		t.Run("Should not append the tiebreaker to groups", func(t *testing.T) {
+			ds := DataState{
+				Group: []GroupDescriptor{
+					{Dir: "asc", Field: "name"},
+				},
+			}
+			ds.WithTiebreaker("id")
+
+			if gotSortFields := ds.getSortFields(); gotSortFields != nil {
+				t.Errorf("DataState.getSortFields() = %v, want nil", gotSortFields)
+			}
+		})
+
+		t.Run("Should use DefaultTiebreaker unless overridden", func(t *testing.T) {
+			DefaultTiebreaker = "id"
+			defer func() { DefaultTiebreaker = "" }()
+
+			ds := DataState{
+				PageSize: 10,
+				Page:     1,
+			}
+
+			wantPipeline := append(ds.getBasePipeline(), []bson.M{
+				{"$sort": bson.D{{Name: "id", Value: 1}}},
+				{"$skip": 0},
+				{"$limit": 10},
+			}...)
+			gotPipeline, err := ds.getPipeline()
+			if err != nil {
+				t.Fatalf("DataState.getPipeline() error = %v", err)
+			}
+			if !reflect.DeepEqual(gotPipeline, wantPipeline) {
+				t.Errorf("DataState.getPipeline() = %v, want %v", gotPipeline, wantPipeline)
+			}
+
+			ds.WithTiebreaker("")
+			if gotSortFields := ds.getSortFields(); gotSortFields != nil {
+				t.Errorf("DataState.getSortFields() = %v, want nil", gotSortFields)
+			}
+		})
+	})
+
+	t.Run("getExposedProject", func(t *testing.T) {
+		t.Run("Should project the exposed fields after the filter", func(t *testing.T) {
+			ds := DataState{
+				Filter: CompositeFilterDescriptor{
+					Filters: []Filter{
+						&FilterDescriptor{Field: "name", Operator: "eq", Value: "a"},
+					},
+				},
+			}
+			ds.WithFieldPolicies(map[string]FieldPolicy{
+				"name":       {Filterable: true},
+				"owner":      {},
+				"owner.name": {Sortable: true},
+			})
+
+			wantPipeline := append(ds.getBasePipeline(), []bson.M{
+				{"$match": bson.M{"name": "a"}},
+				{"$project": bson.M{"id": 1, "name": 1, "owner": 1}},
+			}...)
+
+			gotPipeline, err := ds.getPipeline()
+			if err != nil {
+				t.Fatalf("DataState.getPipeline() error = %v", err)
+			}
+			if !reflect.DeepEqual(gotPipeline, wantPipeline) {
+				t.Errorf("DataState.getPipeline() = %v, want %v", gotPipeline, wantPipeline)
+			}
+		})
+	})
+
+	t.Run("getPaging", func(t *testing.T) {
+		t.Run("Should return skip and limit equal to requested page", func(t *testing.T) {
+			ds := DataState{
+				Page:     3,
+				PageSize: 10,
+			}
+
+			wantPaging := []bson.M{
+				{
+					"$skip": 20,
+				},
+				{
+					"$limit": 10,
+				},
+			}
+
+			if gotPaging := ds.getPaging(); !reflect.DeepEqual(gotPaging, wantPaging) {
+				t.Errorf("DataState.getPaging() = %v, want %v", gotPaging, wantPaging)
+			}
+		})
+	})
+
+	t.Run("getTotalPipeline", func(t *testing.T) {
+		t.Run("Should return the base pipeline and $count if there is no filter or lookups", func(t *testing.T) {
+			ds := DataState{}
+
+			wantTotalPipeline := append(ds.getBasePipeline(), bson.M{
+				"$count": "total",
+			})
+
+			gotTotalPipeline, err := ds.getTotalPipeline()
+			if err != nil {
+				t.Fatalf("DataState.getTotalPipeline() error = %v", err)
+			}
+			if !reflect.DeepEqual(gotTotalPipeline, wantTotalPipeline) {
+				t.Errorf("DataState.getTotalPipeline() = %v, want %v", gotTotalPipeline, wantTotalPipeline)
+			}
+		})
+
+		t.Run("Should return pipeline with filters if present", func(t *testing.T) {
+			ds := DataState{
+				Filter: CompositeFilterDescriptor{
+					Logic: "and",
+					Filters: []Filter{
+						&FilterDescriptor{
+							Field:    "name",
+							Operator: "eq",
+							Value:    "John",
+						},
+					},
+				},
+			}
+
+			filter, _ := ds.getFilter()
+			wantTotalPipeline := append(ds.getBasePipeline(), []bson.M{
+				{"$match": filter},
+				{"$count": "total"},
+			}...)
+
+			gotTotalPipeline, err := ds.getTotalPipeline()
+			if err != nil {
+				t.Fatalf("DataState.getTotalPipeline() error = %v", err)
+			}
+			if !reflect.DeepEqual(gotTotalPipeline, wantTotalPipeline) {
+				t.Errorf("DataState.getTotalPipeline() = %v, want %v", gotTotalPipeline, wantTotalPipeline)
+			}
+		})
+
+		t.Run("Should lookup if a filter is done on the lookup field", func(t *testing.T) {
+			ds := DataState{
+				Filter: CompositeFilterDescriptor{
+					Logic: "and",
+					Filters: []Filter{
+						&FilterDescriptor{
+							Field:    "owner.name",
 							Operator: "eq",
 							Value:    "John",
 						},
@@ -373,6 +1755,7 @@ func TestDataState(t *testing.T) {
 				},
 			}
 
+			filter, _ := ds.getFilter()
 			wantTotalPipeline := append(ds.getBasePipeline(), []bson.M{
 				{
 					"$lookup": bson.M{
@@ -382,11 +1765,15 @@ func TestDataState(t *testing.T) {
 						"as":           "owner",
 					},
 				},
-				{"$match": ds.getFilter()},
+				{"$match": filter},
 				{"$count": "total"},
 			}...)
 
-			if gotTotalPipeline := ds.getTotalPipeline(); !reflect.DeepEqual(gotTotalPipeline, wantTotalPipeline) {
+			gotTotalPipeline, err := ds.getTotalPipeline()
+			if err != nil {
+				t.Fatalf("DataState.getTotalPipeline() error = %v", err)
+			}
+			if !reflect.DeepEqual(gotTotalPipeline, wantTotalPipeline) {
 				t.Errorf("DataState.getTotalPipeline() = %v, want %v", gotTotalPipeline, wantTotalPipeline)
 			}
 		})
@@ -395,8 +1782,8 @@ func TestDataState(t *testing.T) {
 			ds := DataState{
 				Filter: CompositeFilterDescriptor{
 					Logic: "and",
-					Filters: []FilterDescriptor{
-						{
+					Filters: []Filter{
+						&FilterDescriptor{
 							Field:    "name",
 							Operator: "eq",
 							Value:    "John",
@@ -413,14 +1800,210 @@ func TestDataState(t *testing.T) {
 				},
 			}
 
+			filter, _ := ds.getFilter()
 			wantTotalPipeline := append(ds.getBasePipeline(), []bson.M{
-				{"$match": ds.getFilter()},
+				{"$match": filter},
 				{"$count": "total"},
 			}...)
 
-			if gotTotalPipeline := ds.getTotalPipeline(); !reflect.DeepEqual(gotTotalPipeline, wantTotalPipeline) {
+			gotTotalPipeline, err := ds.getTotalPipeline()
+			if err != nil {
+				t.Fatalf("DataState.getTotalPipeline() error = %v", err)
+			}
+			if !reflect.DeepEqual(gotTotalPipeline, wantTotalPipeline) {
+				t.Errorf("DataState.getTotalPipeline() = %v, want %v", gotTotalPipeline, wantTotalPipeline)
+			}
+		})
+
+		t.Run("Should group the documents to count and aggregate them", func(t *testing.T) {
+			ds := DataState{
+				Aggregates: []AggregateDescriptor{
+					{Field: "price", Aggregate: "sum"},
+					{Field: "price", Aggregate: "average"},
+					{Field: "id", Aggregate: "count"},
+				},
+			}
+
+			wantTotalPipeline := append(ds.getBasePipeline(), bson.M{
+				"$group": bson.M{
+					"_id":        nil,
+					"total":      bson.M{"$sum": 1},
+					"aggregate0": bson.M{"$sum": "$price"},
+					"aggregate1": bson.M{"$avg": "$price"},
+					"aggregate2": bson.M{"$sum": 1},
+				},
+			})
+
+			gotTotalPipeline, err := ds.getTotalPipeline()
+			if err != nil {
+				t.Fatalf("DataState.getTotalPipeline() error = %v", err)
+			}
+			if !reflect.DeepEqual(gotTotalPipeline, wantTotalPipeline) {
+				t.Errorf("DataState.getTotalPipeline() = %v, want %v", gotTotalPipeline, wantTotalPipeline)
+			}
+		})
+
+		t.Run("Should sort the documents and finalize the aggregates", func(t *testing.T) {
+			ds := DataState{
+				Aggregates: []AggregateDescriptor{
+					{Field: "price", Aggregate: "last"},
+					{Field: "brand", Aggregate: "countDistinct"},
+				},
+				Sort: []SortDescriptor{
+					{Field: "date", Dir: "asc"},
+				},
+			}
+
+			wantTotalPipeline := append(ds.getBasePipeline(), []bson.M{
+				{"$sort": bson.D{{Name: "date", Value: 1}}},
+				{
+					"$group": bson.M{
+						"_id":        nil,
+						"total":      bson.M{"$sum": 1},
+						"aggregate0": bson.M{"$last": "$price"},
+						"aggregate1": bson.M{"$addToSet": "$brand"},
+					},
+				},
+				{
+					"$addFields": bson.M{
+						"aggregate1": bson.M{"$size": "$aggregate1"},
+					},
+				},
+			}...)
+
+			gotTotalPipeline, err := ds.getTotalPipeline()
+			if err != nil {
+				t.Fatalf("DataState.getTotalPipeline() error = %v", err)
+			}
+			if !reflect.DeepEqual(gotTotalPipeline, wantTotalPipeline) {
+				t.Errorf("DataState.getTotalPipeline() = %v, want %v", gotTotalPipeline, wantTotalPipeline)
+			}
+		})
+
+		t.Run("Should push the values of aggregates without accumulator", func(t *testing.T) {
+			RegisterAggregate("range", func(args ...string) (*Aggregator, error) {
+				return &Aggregator{
+					Expression: func(values interface{}) interface{} {
+						return bson.M{"$subtract": []interface{}{bson.M{"$max": values}, bson.M{"$min": values}}}
+					},
+				}, nil
+			})
+			defer unregisterAggregate("range")
+
+			ds := DataState{
+				Aggregates: []AggregateDescriptor{
+					{Field: "price", Aggregate: "range"},
+				},
+			}
+
+			wantTotalPipeline := append(ds.getBasePipeline(), []bson.M{
+				{
+					"$group": bson.M{
+						"_id":        nil,
+						"total":      bson.M{"$sum": 1},
+						"aggregate0": bson.M{"$push": "$price"},
+					},
+				},
+				{
+					"$addFields": bson.M{
+						"aggregate0": bson.M{
+							"$subtract": []interface{}{bson.M{"$max": "$aggregate0"}, bson.M{"$min": "$aggregate0"}},
+						},
+					},
+				},
+			}...)
+
+			gotTotalPipeline, err := ds.getTotalPipeline()
+			if err != nil {
+				t.Fatalf("DataState.getTotalPipeline() error = %v", err)
+			}
+			if !reflect.DeepEqual(gotTotalPipeline, wantTotalPipeline) {
+				t.Errorf("DataState.getTotalPipeline() = %v, want %v", gotTotalPipeline, wantTotalPipeline)
+			}
+		})
+
+		t.Run("Should lookup if an aggregate is done on the lookup field", func(t *testing.T) {
+			ds := DataState{
+				Aggregates: []AggregateDescriptor{
+					{Field: "owner.age", Aggregate: "max"},
+				},
+				Lookup: []LookupDescriptor{
+					{
+						From:         "users",
+						LocalField:   "owner",
+						ForeignField: "_id",
+						As:           "owner",
+						Single:       true,
+					},
+				},
+			}
+
+			wantTotalPipeline := append(ds.getBasePipeline(), ds.getLookups()...)
+			wantTotalPipeline = append(wantTotalPipeline, ds.getTotalGroup())
+
+			gotTotalPipeline, err := ds.getTotalPipeline()
+			if err != nil {
+				t.Fatalf("DataState.getTotalPipeline() error = %v", err)
+			}
+			if !reflect.DeepEqual(gotTotalPipeline, wantTotalPipeline) {
 				t.Errorf("DataState.getTotalPipeline() = %v, want %v", gotTotalPipeline, wantTotalPipeline)
 			}
 		})
 	})
+
+	t.Run("getTotalAggregates", func(t *testing.T) {
+		ds := DataState{
+			Aggregates: []AggregateDescriptor{
+				{Field: "price", Aggregate: "sum"},
+				{Field: "price", Aggregate: "max"},
+				{Field: "id", Aggregate: "count"},
+			},
+		}
+
+		t.Run("Should key the aggregates by field and aggregate", func(t *testing.T) {
+			want := map[string]map[string]interface{}{
+				"price": {"sum": 30, "max": 20},
+				"id":    {"count": 2},
+			}
+
+			got := ds.getTotalAggregates(bson.M{"aggregate0": 30, "aggregate1": 20, "aggregate2": 2})
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("DataState.getTotalAggregates() = %v, want %v", got, want)
+			}
+		})
+
+		t.Run("Should count 0 documents if none matches", func(t *testing.T) {
+			want := map[string]map[string]interface{}{
+				"price": {"sum": nil, "max": nil},
+				"id":    {"count": 0},
+			}
+
+			got := ds.getTotalAggregates(nil)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("DataState.getTotalAggregates() = %v, want %v", got, want)
+			}
+		})
+
+		t.Run("Should return nil without aggregates", func(t *testing.T) {
+			ds := DataState{}
+			if got := ds.getTotalAggregates(bson.M{}); got != nil {
+				t.Errorf("DataState.getTotalAggregates() = %v, want nil", got)
+			}
+		})
+	})
+}
+
+func unregisterOperator(name string) {
+	operatorsMutex.Lock()
+	defer operatorsMutex.Unlock()
+
+	delete(operators, name)
+	delete(registered, name)
+}
+
+func unregisterAggregate(name string) {
+	aggregatorsMutex.Lock()
+	defer aggregatorsMutex.Unlock()
+
+	delete(aggregators, name)
 }
@@ -1,6 +1,7 @@
 package kendo
 
 type DataResult struct {
-	Data  []interface{} `json:"data"`
-	Total int           `json:"total"`
+	Data       []interface{}                     `json:"data"`
+	Total      int                               `json:"total"`
+	Aggregates map[string]map[string]interface{} `json:"aggregates,omitempty"` // of the filtered documents, e.g. {"price": {"sum": 10}}
 }
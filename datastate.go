@@ -4,46 +4,115 @@ import (
 	"fmt"
 	"net/url"
 	"strings"
+	"time"
 
+	"github.com/globalsign/mgo"
 	"github.com/globalsign/mgo/bson"
 )
 
+// DefaultTiebreaker is the unique field appended to the sort of every DataState without
+// a tiebreaker of its own (see WithTiebreaker), e.g. "id". It is disabled when empty.
+var DefaultTiebreaker = ""
+
 type SortDescriptor struct {
-	Dir   string // asc desc
-	Field string
+	Dir   string `json:"dir"` // asc desc
+	Field string `json:"field"`
 }
 
 type AggregateDescriptor struct {
-	Aggregate string //"count" | "sum" | "average" | "min" | "max"
-	Field     string
+	Aggregate string `json:"aggregate"` //"count" | "sum" | "average" | "min" | "max" or a registered aggregate, see RegisterAggregate
+	Field     string `json:"field"`
 }
 
-func (ad AggregateDescriptor) getExpression(isRoot bool) string {
-	expression := fmt.Sprintf("$items.aggregates.%s.%s", ad.getKey(), ad.Aggregate)
-	if isRoot {
-		expression = fmt.Sprintf("$items.%s", ad.Field)
+// getValues returns the expression of the values of the field, or of the documents, of a group
+// with levels of subgroups, flattening the items of its subgroups
+func (ad AggregateDescriptor) getValues(levels int, documents bool) interface{} {
+
+	var values interface{} = "$items" + strings.Repeat(".items", levels)
+	if !documents {
+		values = fmt.Sprintf("%s.%s", values, ad.Field)
+	}
+	for i := 0; i < levels; i++ {
+		values = bson.M{
+			"$reduce": bson.M{
+				"input":        values,
+				"initialValue": []interface{}{},
+				"in": bson.M{
+					"$concatArrays": []interface{}{"$$value", "$$this"},
+				},
+			},
+		}
 	}
 
-	return expression
+	return values
 }
 
-func (ad AggregateDescriptor) getAggregate() string {
-	key := ad.Aggregate
-	if key == "average" {
-		key = "avg"
+// getSortedValues returns the expression of the values, or of the documents, of a group with levels
+// of subgroups in the order of sort, the items of its subgroups being in the order of the subgroups.
+// Requires MongoDB 5.2.
+func (ad AggregateDescriptor) getSortedValues(levels int, documents bool, sort bson.D) interface{} {
+
+	var values interface{} = bson.M{
+		"$sortArray": bson.M{
+			"input":  ad.getValues(levels, true),
+			"sortBy": sort,
+		},
+	}
+	if !documents {
+		values = bson.M{
+			"$map": bson.M{
+				"input": values,
+				"in":    fmt.Sprintf("$$this.%s", ad.Field),
+			},
+		}
 	}
 
-	return fmt.Sprintf("$%s", key)
+	return values
 }
 
-func (ad AggregateDescriptor) getKey() string {
-	return sanitizeKey(ad.Field)
+// getAccumulator returns the expression computing the aggregate of a group with levels of subgroups,
+// from the aggregates of its subgroups if they have it and it can be combined or from its documents,
+// or nil if the aggregate is unknown. Aggregates of dotted fields cannot be referenced and are computed
+// from the documents. Ordered aggregates are computed from the documents sorted by sort, if any.
+func (ad AggregateDescriptor) getAccumulator(levels int, subgroupsHave bool, sort bson.D) interface{} {
+
+	aggregator, err := ad.getAggregator()
+	if err != nil {
+		return nil
+	}
+
+	if levels > 0 && subgroupsHave && aggregator.Combine != nil && !strings.Contains(ad.Field, ".") {
+		return aggregator.Combine(fmt.Sprintf("$items.aggregates.%s.%s", ad.Field, ad.Aggregate))
+	}
+
+	if levels > 0 && aggregator.Ordered && len(sort) > 0 { // the documents are sorted within their subgroups only
+		return aggregator.Expression(ad.getSortedValues(levels, aggregator.Documents, sort))
+	}
+
+	return aggregator.Expression(ad.getValues(levels, aggregator.Documents))
+}
+
+// getTotalAccumulator returns the accumulator computing the aggregate of all the documents,
+// or nil if the aggregate is unknown
+func (ad AggregateDescriptor) getTotalAccumulator() bson.M {
+
+	aggregator, err := ad.getAggregator()
+	if err != nil {
+		return nil
+	}
+
+	field := fmt.Sprintf("$%s", ad.Field)
+	if aggregator.Accumulator == nil { // computed by getTotalFinalize
+		return bson.M{"$push": field}
+	}
+
+	return aggregator.Accumulator(field)
 }
 
 type GroupDescriptor struct {
-	Aggregates []AggregateDescriptor
-	Dir        string // asc desc
-	Field      string
+	Aggregates []AggregateDescriptor `json:"aggregates,omitempty"`
+	Dir        string                `json:"dir"` // asc desc
+	Field      string                `json:"field"`
 }
 
 func (gd GroupDescriptor) getKey() string {
@@ -59,16 +128,45 @@ func (gd GroupDescriptor) getSort() int {
 	return sort
 }
 
+// Filter is a node of a filter expression, either a *FilterDescriptor or a *CompositeFilterDescriptor
+type Filter interface {
+	filter(d *DataState) (bson.M, error)
+	leaves() []*FilterDescriptor
+}
+
 type FilterDescriptor struct {
-	Field      string
-	IgnoreCase bool
-	Operator   string
-	Value      interface{}
+	Field      string      `json:"field"`
+	IgnoreCase bool        `json:"ignoreCase"`
+	Operator   string      `json:"operator"`
+	Value      interface{} `json:"value"`
+	path       string      // of the field in the document, set in sub-filters, see getPath
+}
+
+func (fd *FilterDescriptor) leaves() []*FilterDescriptor {
+	return []*FilterDescriptor{fd}
+}
+
+// getPath returns the path of the field in the document, e.g. "items.due" for the field
+// due of a sub-filter of items, as used by the schema
+func (fd *FilterDescriptor) getPath() string {
+	if fd.path != "" {
+		return fd.path
+	}
+
+	return fd.Field
 }
 
 type CompositeFilterDescriptor struct {
-	Logic   string             // or and
-	Filters []FilterDescriptor //could also be a CompositeFilterDescriptor
+	Logic   string   `json:"logic"` // or and
+	Filters []Filter `json:"filters"`
+}
+
+func (cfd *CompositeFilterDescriptor) leaves() (leaves []*FilterDescriptor) {
+	for _, f := range cfd.Filters {
+		leaves = append(leaves, f.leaves()...)
+	}
+
+	return
 }
 
 type LookupDescriptor struct { // TODO add toMongo method
@@ -87,9 +185,29 @@ type DataState struct {
 	Sort          []SortDescriptor
 	Lookup        []LookupDescriptor
 	Aggregates    []AggregateDescriptor
+	Search        string // quick search term, see WithSearchFields
 	values        url.Values
+	request       *dataSourceRequest
 	replacements  map[string]string
 	preprocessing []bson.M
+	tiebreaker    *string
+	schema        map[string]FieldType
+	collation     *mgo.Collation
+	nullSemantics NullSemantics
+	searchFields  []string
+	textSearch    bool
+	location      *time.Location
+	limits        Limits
+	policies      map[string]FieldPolicy
+	parsed        bool // by Parse, Apply does not parse again
+	offset        int  // documents skipped after the pages, from a skip that is not a multiple of take
+}
+
+// NullSemantics controls how the null and empty operators treat sparse documents.
+// The zero value matches missing fields as null and only "" as empty.
+type NullSemantics struct {
+	StrictNull  bool // only null values are null, documents without the field are not
+	EmptyArrays bool // empty arrays are empty, as well as ""
 }
 
 func sanitizeKey(s string) string {
@@ -0,0 +1,269 @@
+package kendo
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// Encode returns the DataState as aspnetmvc-ajax query string parameters,
+// e.g. page=2&pageSize=10&sort=name-asc&filter=name~eq~'a'.
+// It returns an *EncodeError if a filter ignores case where the format does not, or the contrary,
+// and for the aggregates of group descriptors, binary values and a skip that is not a multiple
+// of the page size, the format cannot carry them.
+func (d *DataState) Encode() (string, error) {
+
+	if d.offset > 0 {
+		return "", &EncodeError{
+			Param:  "page",
+			Reason: "skip is not a multiple of the page size",
+		}
+	}
+
+	values := url.Values{}
+
+	if d.Page > 0 {
+		values.Set("page", strconv.Itoa(d.Page))
+	}
+
+	if d.PageSize > 0 {
+		values.Set("pageSize", strconv.Itoa(d.PageSize))
+	}
+
+	if len(d.Sort) > 0 {
+		sorts := make([]string, len(d.Sort))
+		for i, s := range d.Sort {
+			sorts[i] = s.Field + "-" + s.Dir
+		}
+		values.Set("sort", strings.Join(sorts, "~"))
+	}
+
+	filter, err := encodeFilter(&d.Filter, d.getLocation())
+	if err != nil {
+		return "", err
+	}
+	if filter != "" {
+		values.Set("filter", filter)
+	}
+
+	if len(d.Group) > 0 {
+		groups := make([]string, len(d.Group))
+		for i, g := range d.Group {
+			if len(g.Aggregates) > 0 {
+				return "", &EncodeError{
+					Param:  "group",
+					Field:  g.Field,
+					Reason: "aggregates of a group descriptor",
+				}
+			}
+			groups[i] = g.Field + "-" + g.Dir
+		}
+		values.Set("group", strings.Join(groups, "~"))
+	}
+
+	if d.Search != "" {
+		values.Set("search", d.Search)
+	}
+
+	if len(d.Aggregates) > 0 {
+		aggregates := make([]string, len(d.Aggregates))
+		for i, a := range d.Aggregates {
+			aggregates[i] = a.Field + "-" + a.Aggregate
+		}
+		values.Set("aggregate", strings.Join(aggregates, "~"))
+	}
+
+	return values.Encode(), nil
+}
+
+// MarshalJSON encodes the DataState as a Kendo DataSourceRequest
+func (d DataState) MarshalJSON() ([]byte, error) {
+
+	request := dataSourceRequest{
+		Page:      d.Page,
+		PageSize:  d.PageSize,
+		Take:      d.PageSize,
+		Sort:      d.Sort,
+		Group:     d.Group,
+		Aggregate: d.Aggregates,
+		Search:    d.Search,
+	}
+
+	if d.Page > 0 {
+		request.Skip = (d.Page-1)*d.PageSize + d.offset
+	}
+
+	if len(d.Filter.Filters) > 0 {
+		request.Filter = &d.Filter
+	}
+
+	return json.Marshal(request)
+}
+
+// MarshalJSON encodes a Kendo filter keeping the type of its value: floats keep a decimal point
+// and ObjectIds are encoded as {"$oid": "..."}, dates are ISO 8601 strings
+func (fd *FilterDescriptor) MarshalJSON() ([]byte, error) {
+
+	return json.Marshal(struct {
+		Field      string      `json:"field"`
+		IgnoreCase bool        `json:"ignoreCase"`
+		Operator   string      `json:"operator"`
+		Value      interface{} `json:"value"`
+	}{
+		Field:      fd.Field,
+		IgnoreCase: fd.IgnoreCase,
+		Operator:   fd.Operator,
+		Value:      toJSONValue(fd.Value),
+	})
+}
+
+// toJSONValue returns the JSON representation of a filter value, see fromJSONValue
+func toJSONValue(value interface{}) interface{} {
+
+	switch v := value.(type) {
+	case float64:
+		if math.IsInf(v, 0) || math.IsNaN(v) {
+			return v // not representable, json.Marshal fails
+		}
+		return json.RawMessage(encodeFloat(v, 64))
+	case float32:
+		return toJSONValue(float64(v))
+	case bson.ObjectId:
+		return map[string]string{"$oid": v.Hex()}
+	case []byte, Filter:
+		return value
+	}
+
+	if value != nil && reflect.ValueOf(value).Kind() == reflect.Slice {
+		list := listValue(value)
+		values := make([]interface{}, len(list))
+		for i := range list {
+			values[i] = toJSONValue(list[i])
+		}
+		return values
+	}
+
+	return value
+}
+
+func encodeFilter(filter Filter, loc *time.Location) (string, error) {
+
+	switch f := filter.(type) {
+	case *CompositeFilterDescriptor:
+		logic := f.Logic
+		if logic == "" {
+			logic = "and"
+		}
+
+		filters := []string{}
+		for _, child := range f.Filters {
+			encoded, err := encodeFilter(child, loc)
+			if err != nil {
+				return "", err
+			}
+			if encoded == "" {
+				continue
+			}
+			if c, ok := child.(*CompositeFilterDescriptor); ok && len(c.Filters) > 1 {
+				encoded = "(" + encoded + ")"
+			}
+			filters = append(filters, encoded)
+		}
+
+		return strings.Join(filters, "~"+logic+"~"), nil
+	case *FilterDescriptor:
+		// the format does not carry ignoreCase, see parseComparison
+		if f.IgnoreCase != isPatternOperator(f.Operator) && hasString(f.Value) {
+			return "", &EncodeError{
+				Param:  "filter",
+				Field:  f.Field,
+				Reason: fmt.Sprintf("ignoreCase %t for operator %q", f.IgnoreCase, f.Operator),
+			}
+		}
+		if _, ok := f.Value.([]byte); ok {
+			return "", &EncodeError{
+				Param:  "filter",
+				Field:  f.Field,
+				Reason: "binary value",
+			}
+		}
+		value, err := encodeValue(f.Value, loc)
+		if err != nil {
+			return "", err
+		}
+		return f.Field + "~" + f.Operator + "~" + value, nil
+	}
+
+	return "", nil
+}
+
+// hasString reports whether the value is a string or a list containing one, which case matters for
+func hasString(value interface{}) bool {
+	if _, ok := value.([]byte); ok {
+		return false
+	}
+	for _, v := range listValue(value) {
+		if _, ok := v.(string); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// encodeValue encodes a filter value, dates are formatted in loc without offset
+func encodeValue(value interface{}, loc *time.Location) (string, error) {
+
+	switch v := value.(type) {
+	case nil:
+		return "null", nil
+	case string:
+		return "'" + strings.Replace(v, "'", "''", -1) + "'", nil
+	case time.Time:
+		return "datetime'" + v.In(loc).Format(TimeLayout+".999999999") + "'", nil
+	case bson.ObjectId:
+		return "objectid'" + v.Hex() + "'", nil
+	case float64:
+		return encodeFloat(v, 64), nil
+	case float32:
+		return encodeFloat(float64(v), 32), nil
+	case Filter:
+		encoded, err := encodeFilter(v, loc)
+		if err != nil {
+			return "", err
+		}
+		return "(" + encoded + ")", nil
+	}
+
+	if reflect.ValueOf(value).Kind() == reflect.Slice {
+		list := listValue(value)
+		values := make([]string, len(list))
+		for i := range list {
+			encoded, err := encodeValue(list[i], loc)
+			if err != nil {
+				return "", err
+			}
+			values[i] = encoded
+		}
+		return "[" + strings.Join(values, ",") + "]", nil
+	}
+
+	return fmt.Sprint(value), nil
+}
+
+// encodeFloat keeps a decimal point so the value is not parsed back as an integer
+func encodeFloat(f float64, bitSize int) string {
+	s := strconv.FormatFloat(f, 'f', -1, bitSize)
+	if !strings.ContainsAny(s, ".IN") { // Inf NaN
+		s += ".0"
+	}
+
+	return s
+}
@@ -0,0 +1,371 @@
+package kendo
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+func TestDataState_Encode(t *testing.T) {
+	t.Run("Should encode the DataState as aspnetmvc-ajax parameters", func(t *testing.T) {
+		d := DataState{
+			Page:     2,
+			PageSize: 10,
+			Sort: []SortDescriptor{
+				{Field: "name", Dir: "asc"},
+			},
+			Filter: CompositeFilterDescriptor{
+				Logic: "or",
+				Filters: []Filter{
+					&FilterDescriptor{Field: "title", Operator: "eq", Value: "it's"},
+					&CompositeFilterDescriptor{
+						Logic: "and",
+						Filters: []Filter{
+							&FilterDescriptor{Field: "due", Operator: "lt", Value: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)},
+							&FilterDescriptor{Field: "total", Operator: "gte", Value: 1.5},
+						},
+					},
+				},
+			},
+			Group: []GroupDescriptor{
+				{Field: "owner", Dir: "desc"},
+			},
+			Aggregates: []AggregateDescriptor{
+				{Field: "total", Aggregate: "sum"},
+			},
+		}
+
+		wantValues := url.Values{
+			"page":      {"2"},
+			"pageSize":  {"10"},
+			"sort":      {"name-asc"},
+			"filter":    {"title~eq~'it''s'~or~(due~lt~datetime'2024-01-01T00-00-00'~and~total~gte~1.5)"},
+			"group":     {"owner-desc"},
+			"aggregate": {"total-sum"},
+		}
+
+		encoded, err := d.Encode()
+		if err != nil {
+			t.Fatalf("DataState.Encode() error = %v", err)
+		}
+		gotValues, err := url.ParseQuery(encoded)
+		if err != nil {
+			t.Fatalf("DataState.Encode() is not a query string: %v", err)
+		}
+		if !reflect.DeepEqual(gotValues, wantValues) {
+			t.Errorf("DataState.Encode() = %v, want %v", gotValues, wantValues)
+		}
+	})
+
+	t.Run("Should round trip through parse", func(t *testing.T) {
+		v := url.Values{}
+		v.Set("page", "3")
+		v.Set("pageSize", "20")
+		v.Set("sort", "name-desc~age-asc")
+		v.Set("filter", "(status~eq~'open'~or~(due~lt~datetime'2024-01-01T00-00-00'~and~owner~eq~'b~o)b'))~and~total~gt~10~and~ratio~lt~2.0~and~active~eq~true~and~deletedAt~eq~null~and~id~eq~objectid'5c4b3c6e9d1f2a0001a1b2c3'~and~at~lt~datetime'2024-01-01T00-00-00.25'~and~status~notin~['a''b',2,2.0,null]~and~items~any~(sku~eq~'X'~or~qty~gt~5)")
+		v.Set("group", "owner-asc~status-desc")
+		v.Set("aggregate", "total-sum~total-average")
+		v.Set("search", "blue car")
+
+		first := DataState{}
+		first.values = v
+		if err := first.Parse(); err != nil {
+			t.Fatalf("DataState.Parse() error = %v", err)
+		}
+
+		encoded, err := first.Encode()
+		if err != nil {
+			t.Fatalf("DataState.Encode() error = %v", err)
+		}
+
+		second := DataState{}
+		second.values, _ = url.ParseQuery(encoded)
+		if err := second.Parse(); err != nil {
+			t.Fatalf("DataState.Parse() error = %v", err)
+		}
+
+		second.values = first.values
+		if !reflect.DeepEqual(first, second) {
+			t.Errorf("DataState.Encode() round trip = %+v, want %+v", second, first)
+		}
+	})
+
+	t.Run("Should not encode filters ignoring case differently from the format", func(t *testing.T) {
+		tests := []struct {
+			filter  *FilterDescriptor
+			wantErr bool
+		}{
+			{&FilterDescriptor{Field: "title", Operator: "eq", Value: "a", IgnoreCase: true}, true},
+			{&FilterDescriptor{Field: "title", Operator: "in", Value: []interface{}{"a", "b"}, IgnoreCase: true}, true},
+			{&FilterDescriptor{Field: "title", Operator: "contains", Value: "a"}, true},
+			{&FilterDescriptor{Field: "title", Operator: "eq", Value: "a"}, false},
+			{&FilterDescriptor{Field: "title", Operator: "contains", Value: "a", IgnoreCase: true}, false},
+			{&FilterDescriptor{Field: "total", Operator: "eq", Value: int64(5), IgnoreCase: true}, false},
+		}
+
+		for _, tt := range tests {
+			d := DataState{Filter: CompositeFilterDescriptor{Logic: "and", Filters: []Filter{
+				&FilterDescriptor{Field: "active", Operator: "eq", Value: true},
+				&CompositeFilterDescriptor{Logic: "or", Filters: []Filter{tt.filter}},
+			}}}
+
+			_, err := d.Encode()
+			if _, ok := err.(*EncodeError); ok != tt.wantErr {
+				t.Errorf("DataState.Encode() %+v error = %v, wantErr %v", tt.filter, err, tt.wantErr)
+			}
+		}
+	})
+
+	t.Run("Should not encode what the format cannot carry", func(t *testing.T) {
+		tests := []struct {
+			d         DataState
+			wantParam string
+		}{
+			{DataState{Group: []GroupDescriptor{{Field: "owner", Dir: "asc", Aggregates: []AggregateDescriptor{{Field: "total", Aggregate: "sum"}}}}}, "group"},
+			{DataState{Filter: CompositeFilterDescriptor{Logic: "and", Filters: []Filter{&FilterDescriptor{Field: "hash", Operator: "eq", Value: []byte{1, 2}}}}}, "filter"},
+			{DataState{Page: 2, PageSize: 10, offset: 5}, "page"},
+		}
+
+		for _, tt := range tests {
+			_, err := tt.d.Encode()
+			if e, ok := err.(*EncodeError); !ok || e.Param != tt.wantParam {
+				t.Errorf("DataState.Encode() error = %v, want EncodeError for %s", err, tt.wantParam)
+			}
+		}
+	})
+}
+
+func TestDataState_EncodeAcrossFormats(t *testing.T) {
+	t.Run("Should round trip a query through JSON", func(t *testing.T) {
+		v := url.Values{}
+		v.Set("filter", "(status~eq~'open'~or~title~contains~'Car')~and~total~gt~10~and~ratio~lt~2.0~and~active~eq~true~and~deletedAt~eq~null~and~id~eq~objectid'5c4b3c6e9d1f2a0001a1b2c3'~and~due~lt~datetime'2024-01-01T00-00-00'~and~status~in~['a',2,2.0]")
+		v.Set("sort", "name-desc")
+		v.Set("page", "2")
+		v.Set("pageSize", "10")
+
+		first := DataState{}
+		first.values = v
+		if err := first.Parse(); err != nil {
+			t.Fatalf("DataState.Parse() error = %v", err)
+		}
+
+		encoded, err := json.Marshal(first)
+		if err != nil {
+			t.Fatalf("DataState.MarshalJSON() error = %v", err)
+		}
+		second, err := NewDataStateFromJSON(bytes.NewReader(encoded))
+		if err != nil {
+			t.Fatalf("NewDataStateFromJSON() error = %v", err)
+		}
+		if err = second.Parse(); err != nil {
+			t.Fatalf("DataState.Parse() error = %v", err)
+		}
+
+		assertSameState(t, first, *second)
+	})
+
+	t.Run("Should round trip JSON through a query", func(t *testing.T) {
+		body := `{
+			"page": 2, "pageSize": 10,
+			"sort": [{"field": "name", "dir": "desc"}],
+			"filter": {"logic": "and", "filters": [
+				{"logic": "or", "filters": [
+					{"field": "status", "operator": "eq", "value": "open", "ignoreCase": false},
+					{"field": "title", "operator": "contains", "value": "Car", "ignoreCase": true}
+				]},
+				{"field": "total", "operator": "gt", "value": 10},
+				{"field": "ratio", "operator": "lt", "value": 2.0},
+				{"field": "id", "operator": "eq", "value": {"$oid": "5c4b3c6e9d1f2a0001a1b2c3"}},
+				{"field": "due", "operator": "lt", "value": "2024-01-01T00:00:00Z"}
+			]}
+		}`
+
+		first, _ := NewDataStateFromJSON(bytes.NewBufferString(body))
+		if err := first.Parse(); err != nil {
+			t.Fatalf("DataState.Parse() error = %v", err)
+		}
+
+		encoded, err := first.Encode()
+		if err != nil {
+			t.Fatalf("DataState.Encode() error = %v", err)
+		}
+		second := DataState{}
+		second.values, _ = url.ParseQuery(encoded)
+		if err = second.Parse(); err != nil {
+			t.Fatalf("DataState.Parse() error = %v", err)
+		}
+
+		assertSameState(t, *first, second)
+	})
+}
+
+// assertSameState compares the parsed descriptors and the compiled filters of two DataStates, the
+// ignoreCase of filters on values that are not strings may differ between formats without effect
+func assertSameState(t *testing.T, want, got DataState) {
+	t.Helper()
+
+	if got.Page != want.Page || got.PageSize != want.PageSize || !reflect.DeepEqual(got.Sort, want.Sort) {
+		t.Errorf("round trip = %+v, want %+v", got, want)
+	}
+
+	wantFilter, err := want.getFilter()
+	if err != nil {
+		t.Fatalf("DataState.getFilter() error = %v", err)
+	}
+	gotFilter, err := got.getFilter()
+	if err != nil {
+		t.Fatalf("DataState.getFilter() error = %v", err)
+	}
+	if !reflect.DeepEqual(gotFilter, wantFilter) {
+		t.Errorf("round trip filter = %v, want %v", gotFilter, wantFilter)
+	}
+}
+
+func TestDataState_EncodeTimezone(t *testing.T) {
+	t.Run("Should encode dates in the timezone", func(t *testing.T) {
+		paris, err := time.LoadLocation("Europe/Paris")
+		if err != nil {
+			t.Skip("Europe/Paris timezone not available")
+		}
+
+		v := url.Values{}
+		v.Set("filter", "due~eq~datetime'2024-03-01T10-15-30'")
+
+		first := DataState{}
+		first.values = v
+		first.WithTimezone(paris)
+		if err := first.Parse(); err != nil {
+			t.Fatalf("DataState.Parse() error = %v", err)
+		}
+
+		encoded, err := first.Encode()
+		if err != nil {
+			t.Fatalf("DataState.Encode() error = %v", err)
+		}
+		gotValues, _ := url.ParseQuery(encoded)
+		if got := gotValues.Get("filter"); got != v.Get("filter") {
+			t.Errorf("DataState.Encode() = %v, want %v", got, v.Get("filter"))
+		}
+	})
+}
+
+func TestDataState_MarshalJSON(t *testing.T) {
+	t.Run("Should encode the DataState as a DataSourceRequest", func(t *testing.T) {
+		d := DataState{
+			Page:     2,
+			PageSize: 10,
+			Filter: CompositeFilterDescriptor{
+				Logic: "and",
+				Filters: []Filter{
+					&FilterDescriptor{Field: "title", Operator: "eq", Value: "a"},
+				},
+			},
+		}
+
+		want := `{"take":10,"skip":10,"page":2,"pageSize":10,"filter":{"logic":"and","filters":[{"field":"title","ignoreCase":false,"operator":"eq","value":"a"}]}}`
+
+		got, err := json.Marshal(d)
+		if err != nil {
+			t.Fatalf("DataState.MarshalJSON() error = %v", err)
+		}
+		if string(got) != want {
+			t.Errorf("DataState.MarshalJSON() = %s, want %s", got, want)
+		}
+	})
+
+	t.Run("Should keep a skip that is not a multiple of take", func(t *testing.T) {
+		d, _ := NewDataStateFromJSON(bytes.NewBufferString(`{"take": 10, "skip": 15}`))
+		if err := d.Parse(); err != nil {
+			t.Fatalf("DataState.Parse() error = %v", err)
+		}
+
+		want := `{"take":10,"skip":15,"page":2,"pageSize":10}`
+
+		got, err := json.Marshal(d)
+		if err != nil {
+			t.Fatalf("DataState.MarshalJSON() error = %v", err)
+		}
+		if string(got) != want {
+			t.Errorf("DataState.MarshalJSON() = %s, want %s", got, want)
+		}
+	})
+
+	t.Run("Should keep the type of the filter values", func(t *testing.T) {
+		id := bson.ObjectIdHex("5c4b3c6e9d1f2a0001a1b2c3")
+		d := DataState{
+			Filter: CompositeFilterDescriptor{
+				Logic: "and",
+				Filters: []Filter{
+					&FilterDescriptor{Field: "ratio", Operator: "eq", Value: 5.0},
+					&FilterDescriptor{Field: "total", Operator: "eq", Value: int64(5)},
+					&FilterDescriptor{Field: "id", Operator: "eq", Value: id},
+					&FilterDescriptor{Field: "status", Operator: "in", Value: []interface{}{2.0, id}},
+				},
+			},
+		}
+
+		encoded, err := json.Marshal(d)
+		if err != nil {
+			t.Fatalf("DataState.MarshalJSON() error = %v", err)
+		}
+		got, err := NewDataStateFromJSON(bytes.NewReader(encoded))
+		if err != nil {
+			t.Fatalf("NewDataStateFromJSON() error = %v", err)
+		}
+		if err = got.Parse(); err != nil {
+			t.Fatalf("DataState.Parse() error = %v", err)
+		}
+
+		want := []interface{}{5.0, int64(5), id, []interface{}{2.0, id}}
+		for i, f := range got.Filter.Filters {
+			if value := f.(*FilterDescriptor).Value; !reflect.DeepEqual(value, want[i]) {
+				t.Errorf("DataState.MarshalJSON() value = %#v, want %#v", value, want[i])
+			}
+		}
+	})
+
+	t.Run("Should round trip through NewDataStateFromJSON", func(t *testing.T) {
+		body := `{
+			"take": 20, "skip": 20, "page": 2, "pageSize": 20,
+			"sort": [{"field": "name", "dir": "desc"}, {"field": "age", "dir": "asc"}],
+			"filter": {"logic": "or", "filters": [
+				{"field": "price", "operator": "gt", "value": 10.5},
+				{"logic": "and", "filters": [
+					{"field": "active", "operator": "eq", "value": true},
+					{"field": "due", "operator": "lt", "value": "2024-03-01T10:15:30Z", "ignoreCase": true},
+					{"field": "owner", "operator": "isnull", "value": null}
+				]}
+			]},
+			"group": [{"field": "owner", "dir": "asc", "aggregates": [{"field": "price", "aggregate": "max"}]}],
+			"aggregate": [{"field": "price", "aggregate": "sum"}]
+		}`
+
+		first, _ := NewDataStateFromJSON(bytes.NewBufferString(body))
+		if err := first.Parse(); err != nil {
+			t.Fatalf("DataState.Parse() error = %v", err)
+		}
+
+		encoded, err := json.Marshal(first)
+		if err != nil {
+			t.Fatalf("DataState.MarshalJSON() error = %v", err)
+		}
+
+		second, err := NewDataStateFromJSON(bytes.NewReader(encoded))
+		if err != nil {
+			t.Fatalf("NewDataStateFromJSON() error = %v", err)
+		}
+		if err = second.Parse(); err != nil {
+			t.Fatalf("DataState.Parse() error = %v", err)
+		}
+
+		second.request = first.request
+		if !reflect.DeepEqual(first, second) {
+			t.Errorf("DataState.MarshalJSON() round trip = %+v, want %+v", second, first)
+		}
+	})
+}
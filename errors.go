@@ -0,0 +1,66 @@
+package kendo
+
+import (
+	"fmt"
+)
+
+// ParseError describes an invalid DataState parameter
+type ParseError struct {
+	Param  string // parameter name, e.g. "filter" or "sort[0][dir]"
+	Token  string // offending token
+	Offset int    // byte offset of the token in the parameter value
+	Reason string
+	Err    error // underlying error, if any
+}
+
+func (e *ParseError) Error() string {
+	msg := fmt.Sprintf("kendo: invalid %s", e.Param)
+	if e.Token != "" {
+		msg += fmt.Sprintf(" at offset %d near %q", e.Offset, e.Token)
+	}
+
+	return msg + ": " + e.Reason
+}
+
+// Unwrap returns the underlying error, e.g. a *strconv.NumError or a *json.SyntaxError
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// UnknownOperatorError is returned when a filter uses an operator that is not registered
+type UnknownOperatorError struct {
+	Field    string
+	Operator string
+}
+
+func (e *UnknownOperatorError) Error() string {
+	return fmt.Sprintf("kendo: unknown operator %q for field %s", e.Operator, e.Field)
+}
+
+// AggregateError is returned when an aggregate is not registered or its arguments are invalid
+type AggregateError struct {
+	Field     string
+	Aggregate string
+	Reason    string
+}
+
+func (e *AggregateError) Error() string {
+	return fmt.Sprintf("kendo: invalid aggregate %q for field %s: %s", e.Aggregate, e.Field, e.Reason)
+}
+
+// EncodeError is returned when a DataState cannot be encoded in the aspnetmvc-ajax format
+// without losing part of it
+type EncodeError struct {
+	Param  string // parameter name, e.g. "filter" or "group"
+	Field  string // field of the descriptor, if any
+	Reason string
+}
+
+func (e *EncodeError) Error() string {
+	msg := fmt.Sprintf("kendo: cannot encode %s", e.Param)
+	if e.Field != "" {
+		msg += fmt.Sprintf(" of field %s", e.Field)
+	}
+
+	return msg + ": " + e.Reason
+}
@@ -0,0 +1,385 @@
+package kendo
+
+import (
+	"strings"
+	"time"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenLParen
+	tokenRParen
+	tokenTilde
+	tokenLBracket
+	tokenRBracket
+	tokenComma
+	tokenWord   // field, operator, logic or bare literal
+	tokenString // 'quoted string', text is unescaped
+	tokenTyped  // prefixed literal such as datetime'...', text is unescaped
+)
+
+type token struct {
+	kind   tokenKind
+	text   string
+	prefix string // only set for tokenTyped
+	offset int
+}
+
+// lexFilter splits a Kendo filter expression into tokens.
+// Quoted strings may contain any character, a quote inside a string is escaped by doubling it.
+func lexFilter(s string) (tokens []token, err error) {
+
+	i := 0
+	for i < len(s) {
+		c := s[i]
+		switch c {
+		case '(':
+			tokens = append(tokens, token{kind: tokenLParen, text: "(", offset: i})
+			i++
+		case ')':
+			tokens = append(tokens, token{kind: tokenRParen, text: ")", offset: i})
+			i++
+		case '~':
+			tokens = append(tokens, token{kind: tokenTilde, text: "~", offset: i})
+			i++
+		case '[':
+			tokens = append(tokens, token{kind: tokenLBracket, text: "[", offset: i})
+			i++
+		case ']':
+			tokens = append(tokens, token{kind: tokenRBracket, text: "]", offset: i})
+			i++
+		case ',':
+			tokens = append(tokens, token{kind: tokenComma, text: ",", offset: i})
+			i++
+		case '\'':
+			var text string
+			start := i
+			if text, i, err = lexQuoted(s, i); err != nil {
+				return
+			}
+			tokens = append(tokens, token{kind: tokenString, text: text, offset: start})
+		default:
+			start := i
+			for i < len(s) && strings.IndexByte("()~'[],", s[i]) == -1 {
+				i++
+			}
+			word := s[start:i]
+			if i < len(s) && s[i] == '\'' { // typed literal, e.g. datetime'...'
+				var text string
+				if text, i, err = lexQuoted(s, i); err != nil {
+					return
+				}
+				tokens = append(tokens, token{kind: tokenTyped, text: text, prefix: word, offset: start})
+				continue
+			}
+			tokens = append(tokens, token{kind: tokenWord, text: word, offset: start})
+		}
+	}
+	tokens = append(tokens, token{kind: tokenEOF, offset: len(s)})
+
+	return
+}
+
+// lexQuoted reads the quoted string starting at s[start] and returns its unescaped value
+// and the offset following the closing quote
+func lexQuoted(s string, start int) (text string, end int, err error) {
+
+	var b strings.Builder
+	for i := start + 1; i < len(s); i++ {
+		if s[i] != '\'' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+1 < len(s) && s[i+1] == '\'' { // escaped quote
+			b.WriteByte('\'')
+			i++
+			continue
+		}
+		return b.String(), i + 1, nil
+	}
+
+	return "", len(s), &ParseError{
+		Param:  "filter",
+		Token:  s[start:],
+		Offset: start,
+		Reason: "unterminated string",
+	}
+}
+
+// filterParser is a recursive descent parser for the Kendo filter grammar:
+//
+//	expression := and ( "~or~" and )*
+//	and        := primary ( "~and~" primary )*
+//	primary    := "(" expression ")" | field "~" operator "~" value
+//	value      := literal | "[" ( literal ( "," literal )* )? "]" | "(" expression ")"
+type filterParser struct {
+	tokens   []token
+	pos      int
+	replace  func(field string) string
+	location *time.Location // of datetime literals without offset
+}
+
+func parseFilter(s string, replace func(string) string, location *time.Location) (filter *CompositeFilterDescriptor, err error) {
+
+	tokens, err := lexFilter(s)
+	if err != nil {
+		return
+	}
+
+	p := &filterParser{
+		tokens:   tokens,
+		replace:  replace,
+		location: location,
+	}
+
+	expression, err := p.parseExpression()
+	if err != nil {
+		return
+	}
+
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, p.unexpected(t)
+	}
+
+	return wrapFilter(expression), nil
+}
+
+func (p *filterParser) parseExpression() (Filter, error) {
+	return p.parseLogic("or", p.parseAnd)
+}
+
+func (p *filterParser) parseAnd() (Filter, error) {
+	return p.parseLogic("and", p.parsePrimary)
+}
+
+// parseLogic parses one or more operands joined by logic
+func (p *filterParser) parseLogic(logic string, operand func() (Filter, error)) (filter Filter, err error) {
+
+	if filter, err = operand(); err != nil {
+		return
+	}
+
+	filters := []Filter{filter}
+	for p.peekLogic(logic) {
+		p.pos += 3 // ~ logic ~
+		if filter, err = operand(); err != nil {
+			return
+		}
+		filters = append(filters, filter)
+	}
+
+	if len(filters) == 1 {
+		return filters[0], nil
+	}
+
+	return &CompositeFilterDescriptor{
+		Logic:   logic,
+		Filters: filters,
+	}, nil
+}
+
+func (p *filterParser) parsePrimary() (filter Filter, err error) {
+
+	if p.peek().kind != tokenLParen {
+		return p.parseComparison()
+	}
+	p.pos++
+
+	if filter, err = p.parseExpression(); err != nil {
+		return
+	}
+
+	if _, err = p.expect(tokenRParen); err != nil {
+		return
+	}
+
+	return
+}
+
+func (p *filterParser) parseComparison() (filter *FilterDescriptor, err error) {
+
+	field, err := p.expect(tokenWord)
+	if err != nil {
+		return
+	}
+	if _, err = p.expect(tokenTilde); err != nil {
+		return
+	}
+
+	operator, err := p.expect(tokenWord)
+	if err != nil {
+		return
+	}
+	if _, err = p.expect(tokenTilde); err != nil {
+		return
+	}
+
+	value, err := p.parseValue()
+	if err != nil {
+		return
+	}
+
+	return &FilterDescriptor{
+		Field:    p.replace(field.text),
+		Operator: operator.text,
+		Value:    value,
+		// the format does not carry it: string patterns ignore case, other operators match
+		// exactly so equality can use an index
+		IgnoreCase: isPatternOperator(operator.text),
+	}, nil
+}
+
+func (p *filterParser) parseValue() (value interface{}, err error) {
+
+	if p.peek().kind == tokenLBracket {
+		var list []interface{}
+		if list, err = p.parseList(); err != nil {
+			return
+		}
+		return list, nil
+	}
+
+	if p.peek().kind == tokenLParen {
+		return p.parseSubFilter()
+	}
+
+	t := p.next()
+	switch t.kind {
+	case tokenString:
+		return t.text, nil
+	case tokenTyped:
+		if t.prefix == "datetime" && isBuiltinLiteral(t.prefix) {
+			value, err = parseDateTimeIn(t.text, p.location)
+			break
+		}
+		fn, ok := getLiteral(t.prefix)
+		if !ok {
+			return nil, &ParseError{
+				Param:  "filter",
+				Token:  t.prefix,
+				Offset: t.offset,
+				Reason: "unknown literal type",
+			}
+		}
+		value, err = fn(t.text)
+	case tokenWord:
+		value, err = parseWord(t.text)
+	default:
+		return nil, p.unexpected(t)
+	}
+
+	if err != nil {
+		return nil, &ParseError{
+			Param:  "filter",
+			Token:  t.text,
+			Offset: t.offset,
+			Reason: "invalid value",
+			Err:    err,
+		}
+	}
+
+	return
+}
+
+// parseList parses a list literal such as ['a','b'], used by the in and notin operators
+func (p *filterParser) parseList() (list []interface{}, err error) {
+
+	p.pos++ // [
+	list = []interface{}{}
+	if p.peek().kind == tokenRBracket {
+		p.pos++
+		return
+	}
+
+	for {
+		var value interface{}
+		if t := p.peek(); t.kind == tokenLBracket || t.kind == tokenLParen { // lists only contain literals
+			return nil, p.unexpected(t)
+		}
+		if value, err = p.parseValue(); err != nil {
+			return
+		}
+		list = append(list, value)
+
+		t := p.next()
+		switch t.kind {
+		case tokenComma:
+		case tokenRBracket:
+			return
+		default:
+			return nil, p.unexpected(t)
+		}
+	}
+}
+
+// parseSubFilter parses the sub-filter of an array operator such as items~any~(sku~eq~'X'~and~qty~gt~5).
+// Its fields are relative to the array element and are not replaced.
+func (p *filterParser) parseSubFilter() (filter *CompositeFilterDescriptor, err error) {
+
+	p.pos++ // (
+	replace := p.replace
+	p.replace = func(field string) string { return field }
+	defer func() { p.replace = replace }()
+
+	expression, err := p.parseExpression()
+	if err != nil {
+		return
+	}
+
+	if _, err = p.expect(tokenRParen); err != nil {
+		return
+	}
+
+	return wrapFilter(expression), nil
+}
+
+func (p *filterParser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *filterParser) next() (t token) {
+	t = p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+
+	return
+}
+
+// peekLogic reports whether the next tokens are "~logic~"
+func (p *filterParser) peekLogic(logic string) bool {
+	if p.pos+2 >= len(p.tokens) {
+		return false
+	}
+
+	return p.tokens[p.pos].kind == tokenTilde &&
+		p.tokens[p.pos+1].kind == tokenWord && p.tokens[p.pos+1].text == logic &&
+		p.tokens[p.pos+2].kind == tokenTilde
+}
+
+func (p *filterParser) expect(kind tokenKind) (t token, err error) {
+	if t = p.next(); t.kind != kind {
+		err = p.unexpected(t)
+	}
+
+	return
+}
+
+func (p *filterParser) unexpected(t token) error {
+	if t.kind == tokenEOF {
+		return &ParseError{
+			Param:  "filter",
+			Offset: t.offset,
+			Reason: "unexpected end of filter",
+		}
+	}
+
+	return &ParseError{
+		Param:  "filter",
+		Token:  t.text,
+		Offset: t.offset,
+		Reason: "unexpected token",
+	}
+}
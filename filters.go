@@ -2,60 +2,245 @@ package kendo
 
 import (
 	"fmt"
+	"reflect"
 	"regexp"
 
 	"github.com/globalsign/mgo/bson"
 )
 
-func (f *FilterDescriptor) filter(filter bson.M) { //TODO use list of operator
-	operator := f.Operator
-	value := f.Value
-	field := f.Field
+// isPatternOperator reports whether the operator matches a string pattern,
+// its value is then always a string whatever the type of the field
+func isPatternOperator(operator string) bool {
+	switch operator {
+	case "startswith", "endswith", "contains", "doesnotstartwith", "doesnotendwith", "doesnotcontain":
+		return true
+	}
+
+	return false
+}
+
+// wrapFilter returns the filter as a composite, a single filter is wrapped in an and composite
+func wrapFilter(filter Filter) *CompositeFilterDescriptor {
+	if composite, ok := filter.(*CompositeFilterDescriptor); ok {
+		return composite
+	}
 
-	var escapedValue string
-	if v, ok := value.(string); ok {
-		escapedValue = regexp.QuoteMeta(v)
+	return &CompositeFilterDescriptor{
+		Logic:   "and",
+		Filters: []Filter{filter},
 	}
+}
+
+// walkLeaves calls fn for each leaf of the filter, including the leaves of the sub-filters
+// of any and all, with the path of their field (e.g. "items.sku")
+func walkLeaves(filter Filter, prefix string, fn func(path string, f *FilterDescriptor) error) error {
+
+	for _, f := range filter.leaves() {
+		if err := fn(prefix+f.Field, f); err != nil {
+			return err
+		}
+		if sub, ok := f.Value.(Filter); ok {
+			if err := walkLeaves(sub, prefix+f.Field+".", fn); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// withPrefix returns a copy of the sub-filter of an array operator whose leaves know their path,
+// prefix being the path of the array field followed by a dot, e.g. "items."
+func withPrefix(filter Filter, prefix string) Filter {
+
+	switch f := filter.(type) {
+	case *CompositeFilterDescriptor:
+		composite := &CompositeFilterDescriptor{
+			Logic: f.Logic,
+		}
+		for _, child := range f.Filters {
+			composite.Filters = append(composite.Filters, withPrefix(child, prefix))
+		}
+		return composite
+	case *FilterDescriptor:
+		leaf := *f
+		leaf.path = prefix + f.Field
+		return &leaf
+	}
+
+	return filter
+}
 
+// isUnaryOperator reports whether the operator ignores the value of the filter
+func isUnaryOperator(operator string) bool {
 	switch operator {
-	case "eq":
-		filter[field] = value
-	case "ne":
-		filter[field] = bson.M{
-			"$ne": value,
-		}
-	case "isnull":
-		filter[field] = nil
-	case "isnotnull":
-		filter[field] = bson.M{
-			"$ne": nil,
-		}
-	case "lt", "lte", "gt", "gte":
-		filter[field] = bson.M{
-			("$" + operator): value,
-		}
-	case "startswith":
-		filter[field] = bson.M{
-			"$regex": fmt.Sprintf("^%s", escapedValue), "$options": "i",
-		}
-	case "endswith":
-		filter[field] = bson.M{
-			"$regex": fmt.Sprintf("%s$", escapedValue), "$options": "i",
-		}
-	case "contains":
-		filter[field] = bson.M{
-			"$regex": fmt.Sprintf("%s", escapedValue), "$options": "i",
-		}
-	case "doesnotcontain":
-		//TODO case insensitive
-		filter[field] = bson.M{
-			"$not": fmt.Sprintf("%s", value),
-		}
-	case "isempty":
-		filter[field] = ""
-	case "isnotempty":
-		filter[field] = bson.M{
-			"$ne": "",
+	case "isnull", "isnotnull", "isempty", "isnotempty", "isnullorempty", "isnotnullorempty":
+		return true
+	}
+
+	return false
+}
+
+func (f *FilterDescriptor) filter(d *DataState) (bson.M, error) {
+
+	fn, ok := getOperator(f.Operator)
+	if !ok {
+		return nil, &UnknownOperatorError{
+			Field:    f.Field,
+			Operator: f.Operator,
+		}
+	}
+
+	return fn(d, f)
+}
+
+// pattern returns the value escaped for a regular expression, values that are not strings
+// are formatted, e.g. 42 matches "42", and null is empty
+func (f *FilterDescriptor) pattern() string {
+	s, isString := f.Value.(string)
+	if !isString && f.Value != nil {
+		s = fmt.Sprint(f.Value)
+	}
+
+	return regexp.QuoteMeta(s)
+}
+
+// matchCase reports whether the value can be compared as is, with a collation
+// the comparison is done by MongoDB, which can use an index
+func (f *FilterDescriptor) matchCase(d *DataState) bool {
+	_, isString := f.Value.(string)
+
+	return !isString || !f.IgnoreCase || d.collation != nil
+}
+
+// regex returns a $regex condition, case insensitive if the filter ignores case
+func (f *FilterDescriptor) regex(pattern string) bson.M {
+	regex := bson.M{
+		"$regex": pattern,
+	}
+	if f.IgnoreCase {
+		regex["$options"] = "i"
+	}
+
+	return regex
+}
+
+// notRegex returns a negated regular expression condition, case insensitive if the filter ignores case.
+// Like Kendo, which compares (value || ""), documents where the field is missing or null match.
+func (f *FilterDescriptor) notRegex(pattern string) bson.M {
+	regex := bson.RegEx{
+		Pattern: pattern,
+	}
+	if f.IgnoreCase {
+		regex.Options = "i"
+	}
+
+	return bson.M{
+		"$not": regex,
+	}
+}
+
+// list returns the elements of an in or notin condition, strings are matched as
+// case insensitive regular expressions if the filter ignores case
+func (f *FilterDescriptor) list(d *DataState, values ...interface{}) []interface{} {
+
+	list := make([]interface{}, len(values))
+	for i, value := range values {
+		list[i] = value
+		if s, ok := value.(string); ok && f.IgnoreCase && d.collation == nil {
+			list[i] = bson.RegEx{Pattern: fmt.Sprintf("^%s$", regexp.QuoteMeta(s)), Options: "i"}
+		}
+	}
+
+	return list
+}
+
+// listValue returns the elements of a list value, any other value is a list of one element
+func listValue(value interface{}) []interface{} {
+
+	if list, ok := value.([]interface{}); ok {
+		return list
+	}
+
+	v := reflect.ValueOf(value)
+	if v.Kind() != reflect.Slice || v.Type().Elem().Kind() == reflect.Uint8 { // []byte is a binary value
+		return []interface{}{value}
+	}
+
+	list := make([]interface{}, v.Len())
+	for i := range list {
+		list[i] = v.Index(i).Interface()
+	}
+
+	return list
+}
+
+// collapse compiles a disjunction of eq filters on the same field, as sent by
+// a multi checkbox column filter, to $in and a conjunction of neq filters to $nin
+func (cfd *CompositeFilterDescriptor) collapse(d *DataState) (filter bson.M, ok bool) {
+
+	if len(cfd.Filters) < 2 {
+		return
+	}
+
+	operator := "$nin"
+	accepted := map[string]bool{"ne": true, "neq": true}
+	if cfd.Logic == "or" {
+		operator = "$in"
+		accepted = map[string]bool{"eq": true}
+	}
+
+	var field string
+	var values []interface{}
+	for i, child := range cfd.Filters {
+		f, isLeaf := child.(*FilterDescriptor)
+		if !isLeaf || !accepted[f.Operator] || !isBuiltinOperator(f.Operator) || (i > 0 && f.Field != field) {
+			return nil, false
 		}
+		if _, _, isDay := d.dayRange(f); isDay { // days are ranges
+			return nil, false
+		}
+		field = f.Field
+		values = append(values, f.list(d, f.Value)...)
 	}
+
+	return bson.M{
+		field: bson.M{
+			operator: values,
+		},
+	}, true
+}
+
+func (cfd *CompositeFilterDescriptor) filter(d *DataState) (bson.M, error) {
+
+	if filter, ok := cfd.collapse(d); ok {
+		return filter, nil
+	}
+
+	filters := []bson.M{}
+	for _, f := range cfd.Filters {
+		filter, err := f.filter(d)
+		if err != nil {
+			return nil, err
+		}
+		if len(filter) > 0 {
+			filters = append(filters, filter)
+		}
+	}
+
+	switch len(filters) {
+	case 0:
+		return bson.M{}, nil
+	case 1:
+		return filters[0], nil
+	}
+
+	logic := "$and"
+	if cfd.Logic == "or" {
+		logic = "$or"
+	}
+
+	return bson.M{
+		logic: filters,
+	}, nil
 }
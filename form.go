@@ -0,0 +1,319 @@
+package kendo
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// formParams are the parameters of both DataSource formats, bracket indexed in the jQuery format
+var formParams = []string{"filter", "sort", "group", "aggregate"}
+
+// isFormEncoded reports whether the values use the jQuery (bracket indexed) DataSource format,
+// e.g. take=10&skip=0&sort[0][field]=name&sort[0][dir]=asc. Other bracket keys, such as ids[]=1,
+// are ignored. It returns a ParseError if the values also use the aspnetmvc-ajax format.
+func isFormEncoded(values url.Values) (bool, error) {
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	form := ""
+	for _, key := range keys {
+		if key == "take" || key == "skip" {
+			form = key
+		}
+		for _, param := range formParams {
+			if strings.HasPrefix(key, param+"[") {
+				form = key
+			}
+		}
+		if form != "" {
+			break
+		}
+	}
+	if form == "" {
+		return false, nil
+	}
+
+	for _, param := range formParams {
+		if _, ok := values[param]; ok {
+			return false, &ParseError{
+				Param:  param,
+				Reason: fmt.Sprintf("cannot be combined with the jQuery DataSource parameter %s", form),
+			}
+		}
+	}
+
+	return true, nil
+}
+
+// newFormRequest converts jQuery DataSource parameters to a dataSourceRequest.
+// Filter values are kept as strings since the format does not carry their type.
+func newFormRequest(values url.Values) (request *dataSourceRequest, err error) {
+
+	tree, err := formTree(values)
+	if err != nil {
+		return
+	}
+
+	request = new(dataSourceRequest)
+
+	ints := map[string]*int{
+		"take":     &request.Take,
+		"skip":     &request.Skip,
+		"page":     &request.Page,
+		"pageSize": &request.PageSize,
+	}
+	for key, i := range ints {
+		if *i, err = formInt(tree, key); err != nil {
+			return
+		}
+	}
+
+	sorts, err := formList(tree["sort"], "sort")
+	if err != nil {
+		return
+	}
+	for _, s := range sorts {
+		request.Sort = append(request.Sort, SortDescriptor{
+			Field: formString(s, "field"),
+			Dir:   formString(s, "dir"),
+		})
+	}
+
+	if filter, ok := tree["filter"].(map[string]interface{}); ok {
+		var f Filter
+		if f, err = formFilter(filter, "filter"); err != nil {
+			return
+		}
+		request.Filter = wrapFilter(f)
+	}
+
+	groups, err := formList(tree["group"], "group")
+	if err != nil {
+		return
+	}
+	for i, g := range groups {
+		var aggregates []AggregateDescriptor
+		if aggregates, err = formAggregates(g["aggregates"], fmt.Sprintf("group[%d][aggregates]", i)); err != nil {
+			return
+		}
+		request.Group = append(request.Group, GroupDescriptor{
+			Field:      formString(g, "field"),
+			Dir:        formString(g, "dir"),
+			Aggregates: aggregates,
+		})
+	}
+
+	request.Search = formString(tree, "search")
+	request.Aggregate, err = formAggregates(tree["aggregate"], "aggregate")
+
+	return
+}
+
+func formFilter(node map[string]interface{}, key string) (filter Filter, err error) {
+
+	if _, ok := node["filters"]; !ok {
+		leaf := &FilterDescriptor{
+			Field:      formString(node, "field"),
+			Operator:   formString(node, "operator"),
+			IgnoreCase: formString(node, "ignoreCase") != "false", // Kendo defaults to true
+			Value:      formValue(node["value"]),
+		}
+		if value, ok := node["value"].(map[string]interface{}); ok && (value["filters"] != nil || value["operator"] != nil) { // sub-filter
+			var sub Filter
+			if sub, err = formFilter(value, key+"[value]"); err != nil {
+				return
+			}
+			leaf.Value = wrapFilter(sub)
+		}
+		return leaf, nil
+	}
+
+	key = key + "[filters]"
+	children, err := formList(node["filters"], key)
+	if err != nil {
+		return
+	}
+
+	composite := &CompositeFilterDescriptor{
+		Logic: formString(node, "logic"),
+	}
+	for i, child := range children {
+		var f Filter
+		if f, err = formFilter(child, fmt.Sprintf("%s[%d]", key, i)); err != nil {
+			return
+		}
+		composite.Filters = append(composite.Filters, f)
+	}
+
+	return composite, nil
+}
+
+func formAggregates(node interface{}, key string) (aggregates []AggregateDescriptor, err error) {
+
+	items, err := formList(node, key)
+	if err != nil {
+		return
+	}
+
+	for _, a := range items {
+		aggregates = append(aggregates, AggregateDescriptor{
+			Field:     formString(a, "field"),
+			Aggregate: formString(a, "aggregate"),
+		})
+	}
+
+	return
+}
+
+// formTree nests bracket indexed parameters, filter[filters][0][field]=x becomes
+// {"filter": {"filters": {"0": {"field": "x"}}}}. Lists (key[]=a&key[]=b) are kept as []string.
+func formTree(values url.Values) (tree map[string]interface{}, err error) {
+
+	tree = map[string]interface{}{}
+	for key, v := range values {
+		segments, ok := formKey(key)
+		if !ok {
+			return nil, &ParseError{
+				Param:  key,
+				Reason: "malformed brackets",
+			}
+		}
+
+		var value interface{} = v[0]
+		if last := len(segments) - 1; last > 0 && segments[last] == "" {
+			segments = segments[:last]
+			value = v
+		}
+
+		node := tree
+		for _, segment := range segments[:len(segments)-1] {
+			child, ok := node[segment].(map[string]interface{})
+			if !ok {
+				child = map[string]interface{}{}
+				node[segment] = child
+			}
+			node = child
+		}
+		node[segments[len(segments)-1]] = value
+	}
+
+	return
+}
+
+// formKey splits a key such as filter[filters][0][field] into its segments
+func formKey(key string) (segments []string, ok bool) {
+
+	i := strings.Index(key, "[")
+	if i == -1 {
+		return []string{key}, true
+	}
+
+	segments = []string{key[:i]}
+	for rest := key[i:]; rest != ""; {
+		j := strings.Index(rest, "]")
+		if rest[0] != '[' || j == -1 {
+			return nil, false
+		}
+		segments = append(segments, rest[1:j])
+		rest = rest[j+1:]
+	}
+
+	return segments, true
+}
+
+// formList returns the items of an indexed node ({"0": ..., "1": ...}) ordered by index
+func formList(node interface{}, key string) (items []map[string]interface{}, err error) {
+
+	if node == nil {
+		return
+	}
+
+	m, ok := node.(map[string]interface{})
+	if !ok {
+		return nil, &ParseError{
+			Param:  key,
+			Reason: "expected an indexed list",
+		}
+	}
+
+	indexes := make([]int, 0, len(m))
+	for k := range m {
+		i, err := strconv.Atoi(k)
+		if err != nil || i < 0 {
+			return nil, &ParseError{
+				Param:  key,
+				Token:  k,
+				Reason: "expected an index",
+				Err:    err,
+			}
+		}
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+
+	for _, i := range indexes {
+		item, ok := m[strconv.Itoa(i)].(map[string]interface{})
+		if !ok {
+			return nil, &ParseError{
+				Param:  fmt.Sprintf("%s[%d]", key, i),
+				Reason: "expected an object",
+			}
+		}
+		items = append(items, item)
+	}
+
+	return
+}
+
+// formValue converts a filter value node: lists become []interface{}, other values are kept as strings
+func formValue(node interface{}) interface{} {
+
+	switch v := node.(type) {
+	case []string:
+		list := make([]interface{}, len(v))
+		for i := range v {
+			list[i] = v[i]
+		}
+		return list
+	case map[string]interface{}:
+		indexes := make([]int, 0, len(v))
+		for k := range v {
+			i, err := strconv.Atoi(k)
+			if err != nil {
+				return nil
+			}
+			indexes = append(indexes, i)
+		}
+		sort.Ints(indexes)
+
+		list := make([]interface{}, len(indexes))
+		for i, index := range indexes {
+			list[i] = formValue(v[strconv.Itoa(index)])
+		}
+		return list
+	}
+
+	return node
+}
+
+func formString(node map[string]interface{}, key string) string {
+	s, _ := node[key].(string)
+
+	return s
+}
+
+func formInt(node map[string]interface{}, key string) (i int, err error) {
+	s, ok := node[key].(string)
+	if !ok || s == "" {
+		return
+	}
+
+	return parseCount(key, s)
+}
@@ -0,0 +1,368 @@
+package kendo
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// dataSourceRequest is the JSON representation of a Kendo DataSourceRequest
+type dataSourceRequest struct {
+	Take      int                        `json:"take,omitempty"`
+	Skip      int                        `json:"skip,omitempty"`
+	Page      int                        `json:"page,omitempty"`
+	PageSize  int                        `json:"pageSize,omitempty"`
+	Sort      []SortDescriptor           `json:"sort,omitempty"`
+	Filter    *CompositeFilterDescriptor `json:"filter,omitempty"`
+	Group     []GroupDescriptor          `json:"group,omitempty"`
+	Aggregate []AggregateDescriptor      `json:"aggregate,omitempty"`
+	Search    string                     `json:"search,omitempty"`
+}
+
+// NewDataStateFromJSON creates a *DataState from a JSON encoded Kendo DataSourceRequest,
+// as sent by a DataSource using parameterMap: JSON.stringify
+func NewDataStateFromJSON(r io.Reader) (dataState *DataState, err error) {
+
+	request := new(dataSourceRequest)
+	if err = json.NewDecoder(r).Decode(request); err != nil {
+		return nil, newJSONParseError(err)
+	}
+
+	dataState = new(DataState)
+	dataState.request = request
+
+	return
+}
+
+func (d *DataState) parseRequest(request *dataSourceRequest) (err error) {
+
+	if err = request.validate(); err != nil {
+		return
+	}
+
+	d.Page = request.Page
+	d.PageSize = request.PageSize
+	d.offset = 0
+	if request.Take > 0 && (d.PageSize == 0 || request.Skip > 0) {
+		// skip is exact, with virtual scrolling it is not a multiple of take
+		d.PageSize = request.Take
+		d.Page = request.Skip/request.Take + 1
+		d.offset = request.Skip % request.Take
+	}
+
+	if request.Filter != nil {
+		d.Filter = *copyFilter(request.Filter, d.replaceField).(*CompositeFilterDescriptor)
+	}
+
+	d.Sort = nil
+	for _, s := range request.Sort {
+		s.Field = d.replaceField(s.Field)
+		d.Sort = append(d.Sort, s)
+	}
+
+	d.Group = nil
+	for _, g := range request.Group {
+		g.Field = d.replaceField(g.Field)
+		g.Aggregates = d.copyAggregates(g.Aggregates)
+		d.Group = append(d.Group, g)
+	}
+
+	d.Aggregates = d.copyAggregates(request.Aggregate)
+	if request.Search != "" {
+		d.Search = request.Search
+	}
+
+	return
+}
+
+func (r *dataSourceRequest) validate() error {
+
+	counts := map[string]int{
+		"take":     r.Take,
+		"skip":     r.Skip,
+		"page":     r.Page,
+		"pageSize": r.PageSize,
+	}
+	for param, count := range counts {
+		if count < 0 {
+			return &ParseError{
+				Param:  param,
+				Token:  strconv.Itoa(count),
+				Reason: "expected a positive integer",
+			}
+		}
+	}
+
+	for i, s := range r.Sort {
+		if err := checkDescriptor(fmt.Sprintf("sort[%d]", i), s.Field, s.Dir); err != nil {
+			return err
+		}
+	}
+
+	for i, g := range r.Group {
+		param := fmt.Sprintf("group[%d]", i)
+		if err := checkDescriptor(param, g.Field, g.Dir); err != nil {
+			return err
+		}
+		for j, a := range g.Aggregates {
+			if a.Field == "" || a.Aggregate == "" {
+				return &ParseError{
+					Param:  fmt.Sprintf("%s[aggregates][%d]", param, j),
+					Reason: "expected a field and an aggregate",
+				}
+			}
+		}
+	}
+
+	for i, a := range r.Aggregate {
+		if a.Field == "" || a.Aggregate == "" {
+			return &ParseError{
+				Param:  fmt.Sprintf("aggregate[%d]", i),
+				Reason: "expected a field and an aggregate",
+			}
+		}
+	}
+
+	if r.Filter != nil {
+		return checkFilter("filter", r.Filter)
+	}
+
+	return nil
+}
+
+func checkDescriptor(param string, field string, dir string) error {
+	if field == "" {
+		return &ParseError{
+			Param:  param + "[field]",
+			Reason: "expected a field",
+		}
+	}
+
+	return checkDir(param+"[dir]", dir, 0)
+}
+
+func checkFilter(param string, filter Filter) error {
+
+	switch f := filter.(type) {
+	case *CompositeFilterDescriptor:
+		if f.Logic != "" && f.Logic != "and" && f.Logic != "or" {
+			return &ParseError{
+				Param:  param + "[logic]",
+				Token:  f.Logic,
+				Reason: `expected "and" or "or"`,
+			}
+		}
+		for i, child := range f.Filters {
+			if err := checkFilter(fmt.Sprintf("%s[filters][%d]", param, i), child); err != nil {
+				return err
+			}
+		}
+	case *FilterDescriptor:
+		if f.Field == "" || f.Operator == "" {
+			return &ParseError{
+				Param:  param,
+				Reason: "expected a field and an operator",
+			}
+		}
+		if sub, ok := f.Value.(Filter); ok {
+			return checkFilter(param+"[value]", sub)
+		}
+		for _, v := range listValue(f.Value) {
+			if _, ok := v.(map[string]interface{}); ok { // would be a query operator in $match, e.g. {"$ne": null}
+				return &ParseError{
+					Param:  param + "[value]",
+					Reason: "expected a value, not an object",
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func newJSONParseError(err error) error {
+
+	e := &ParseError{
+		Param:  "body",
+		Reason: err.Error(),
+		Err:    err,
+	}
+
+	switch err := err.(type) {
+	case *json.SyntaxError:
+		e.Offset = int(err.Offset)
+	case *json.UnmarshalTypeError:
+		e.Offset = int(err.Offset)
+		e.Token = err.Value
+	}
+
+	return e
+}
+
+// copyFilter deep copies a filter tree replacing its fields, fields of sub-filters are not replaced
+func copyFilter(filter Filter, replace func(string) string) Filter {
+
+	switch f := filter.(type) {
+	case *CompositeFilterDescriptor:
+		composite := &CompositeFilterDescriptor{
+			Logic: f.Logic,
+		}
+		for _, child := range f.Filters {
+			composite.Filters = append(composite.Filters, copyFilter(child, replace))
+		}
+		return composite
+	case *FilterDescriptor:
+		leaf := *f
+		leaf.Field = replace(f.Field)
+		if sub, ok := f.Value.(Filter); ok {
+			leaf.Value = copyFilter(sub, func(field string) string { return field })
+		}
+		return &leaf
+	}
+
+	return filter
+}
+
+func (d *DataState) copyAggregates(aggregates []AggregateDescriptor) (copied []AggregateDescriptor) {
+	for _, a := range aggregates {
+		a.Field = d.replaceField(a.Field)
+		copied = append(copied, a)
+	}
+
+	return
+}
+
+// UnmarshalJSON decodes a Kendo filter expression, where each item of filters
+// is either a filter ({field, operator, value}) or a nested expression ({logic, filters})
+func (cfd *CompositeFilterDescriptor) UnmarshalJSON(data []byte) (err error) {
+
+	var composite struct {
+		Logic   string            `json:"logic"`
+		Filters []json.RawMessage `json:"filters"`
+	}
+	if err = json.Unmarshal(data, &composite); err != nil {
+		return
+	}
+
+	cfd.Logic = composite.Logic
+	cfd.Filters = nil
+	for _, raw := range composite.Filters {
+		var filter Filter
+		if filter, err = unmarshalFilter(raw); err != nil {
+			return
+		}
+		cfd.Filters = append(cfd.Filters, filter)
+	}
+
+	return
+}
+
+// UnmarshalJSON decodes a Kendo filter, typing its value
+func (fd *FilterDescriptor) UnmarshalJSON(data []byte) (err error) {
+
+	var filter struct {
+		Field      string          `json:"field"`
+		Operator   string          `json:"operator"`
+		IgnoreCase *bool           `json:"ignoreCase"`
+		Value      json.RawMessage `json:"value"`
+	}
+	if err = json.Unmarshal(data, &filter); err != nil {
+		return
+	}
+
+	var value interface{}
+	if isJSONFilter(filter.Value) { // sub-filter of an array operator
+		var sub Filter
+		if sub, err = unmarshalFilter(filter.Value); err != nil {
+			return
+		}
+		value = wrapFilter(sub)
+	} else if len(filter.Value) > 0 {
+		decoder := json.NewDecoder(bytes.NewReader(filter.Value))
+		decoder.UseNumber()
+		if err = decoder.Decode(&value); err != nil {
+			return
+		}
+	}
+
+	dates := !isPatternOperator(filter.Operator) // patterns match strings
+	*fd = FilterDescriptor{
+		Field:      filter.Field,
+		Operator:   filter.Operator,
+		IgnoreCase: filter.IgnoreCase == nil || *filter.IgnoreCase, // Kendo defaults to true
+		Value:      fromJSONValue(value, dates),
+	}
+
+	return
+}
+
+// isJSONFilter reports whether the value is a filter object, with filters or an operator
+func isJSONFilter(data []byte) bool {
+
+	if data = bytes.TrimSpace(data); len(data) == 0 || data[0] != '{' {
+		return false
+	}
+
+	var probe struct {
+		Filters  json.RawMessage `json:"filters"`
+		Operator json.RawMessage `json:"operator"`
+	}
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return false
+	}
+
+	return probe.Filters != nil || probe.Operator != nil
+}
+
+func unmarshalFilter(data []byte) (filter Filter, err error) {
+
+	var probe struct {
+		Filters json.RawMessage `json:"filters"`
+	}
+	if err = json.Unmarshal(data, &probe); err != nil {
+		return
+	}
+
+	if probe.Filters != nil {
+		filter = new(CompositeFilterDescriptor)
+	} else {
+		filter = new(FilterDescriptor)
+	}
+	err = json.Unmarshal(data, filter)
+
+	return
+}
+
+// fromJSONValue types a decoded JSON value: integers become int64, other numbers float64
+// and, with dates, ISO 8601 strings (JSON.stringify of a Date) time.Time, {"$oid": "..."} becomes bson.ObjectId
+func fromJSONValue(value interface{}, dates bool) interface{} {
+
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		if f, err := v.Float64(); err == nil {
+			return f
+		}
+	case string:
+		if t, err := time.Parse(time.RFC3339Nano, v); err == nil && dates {
+			return t
+		}
+	case map[string]interface{}:
+		if hex, ok := v["$oid"].(string); ok && len(v) == 1 && bson.IsObjectIdHex(hex) {
+			return bson.ObjectIdHex(hex)
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = fromJSONValue(v[i], dates)
+		}
+	}
+
+	return value
+}
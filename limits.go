@@ -0,0 +1,116 @@
+package kendo
+
+import (
+	"fmt"
+)
+
+// Limits bounds the complexity of the queries a DataState accepts, a zero value is unlimited
+type Limits struct {
+	MaxPageSize     int  // also requires a page size
+	ClampPageSize   bool // reduce a larger, or missing, page size to MaxPageSize instead of rejecting it
+	MaxFilterDepth  int  // nesting of filter expressions, sub-filters included
+	MaxFilters      int  // number of filters, sub-filters included
+	MaxGroups       int
+	MaxAggregates   int // aggregates of the DataState and of its groups
+	MaxStringLength int // length of string filter values and of the search term
+	MaxSkip         int // number of documents skipped by paging
+}
+
+// LimitError is returned when a DataState exceeds one of its Limits
+type LimitError struct {
+	Limit string // name of the Limits field, e.g. "MaxPageSize"
+	Max   int
+	Value int // 0 if unbounded, e.g. without page size
+}
+
+func (e *LimitError) Error() string {
+	if e.Value == 0 {
+		return fmt.Sprintf("kendo: unbounded value exceeds %s %d", e.Limit, e.Max)
+	}
+
+	return fmt.Sprintf("kendo: %d exceeds %s %d", e.Value, e.Limit, e.Max)
+}
+
+// WithLimits sets the limits enforced when the DataState is parsed
+func (d *DataState) WithLimits(limits Limits) {
+	d.limits = limits
+}
+
+func (d *DataState) checkLimits() error {
+
+	limits := d.limits
+	// without page size all the documents are returned
+	if limits.MaxPageSize > 0 && (d.PageSize == 0 || d.PageSize > limits.MaxPageSize) {
+		if !limits.ClampPageSize {
+			return &LimitError{Limit: "MaxPageSize", Max: limits.MaxPageSize, Value: d.PageSize}
+		}
+		d.PageSize = limits.MaxPageSize
+		if d.Page < 1 {
+			d.Page = 1
+		}
+	}
+
+	filters, longest := 0, 0
+	walkLeaves(&d.Filter, "", func(path string, f *FilterDescriptor) error {
+		filters++
+		for _, value := range listValue(f.Value) {
+			if s, ok := value.(string); ok && len(s) > longest {
+				longest = len(s)
+			}
+		}
+		return nil
+	})
+	if len(d.Search) > longest {
+		longest = len(d.Search)
+	}
+
+	aggregates := len(d.Aggregates)
+	for _, g := range d.Group {
+		aggregates += len(g.Aggregates)
+	}
+
+	skip := d.offset
+	if d.Page > 1 {
+		skip += (d.Page - 1) * d.PageSize
+	}
+
+	checks := []struct {
+		limit string
+		max   int
+		value int
+	}{
+		{"MaxFilterDepth", limits.MaxFilterDepth, filterDepth(&d.Filter)},
+		{"MaxFilters", limits.MaxFilters, filters},
+		{"MaxGroups", limits.MaxGroups, len(d.Group)},
+		{"MaxAggregates", limits.MaxAggregates, aggregates},
+		{"MaxStringLength", limits.MaxStringLength, longest},
+		{"MaxSkip", limits.MaxSkip, skip},
+	}
+	for _, c := range checks {
+		if c.max > 0 && c.value > c.max {
+			return &LimitError{Limit: c.limit, Max: c.max, Value: c.value}
+		}
+	}
+
+	return nil
+}
+
+// filterDepth returns the nesting of filter expressions, a list of filters has a depth of 1
+func filterDepth(filter Filter) (depth int) {
+
+	switch f := filter.(type) {
+	case *CompositeFilterDescriptor:
+		for _, child := range f.Filters {
+			if d := filterDepth(child); d > depth {
+				depth = d
+			}
+		}
+		return depth + 1
+	case *FilterDescriptor:
+		if sub, ok := f.Value.(Filter); ok {
+			return filterDepth(sub)
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,127 @@
+package kendo
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// LiteralFunc converts the text of a typed literal, e.g. the hex of objectid'5c4b...', to a value
+type LiteralFunc func(text string) (interface{}, error)
+
+var (
+	literalsMutex sync.RWMutex
+	literals      = map[string]LiteralFunc{
+		"datetime": parseDateTime,
+		"guid":     parseGUID,
+		"objectid": parseObjectID,
+	}
+	registeredLiterals = map[string]bool{} // literals registered or replaced by RegisterLiteral
+)
+
+// RegisterLiteral registers the prefix of a typed filter literal, replacing any existing one.
+// For example RegisterLiteral("decimal", ...) parses values such as price~eq~decimal'10.50'.
+func RegisterLiteral(prefix string, fn LiteralFunc) {
+	literalsMutex.Lock()
+	defer literalsMutex.Unlock()
+
+	literals[prefix] = fn
+	registeredLiterals[prefix] = true
+}
+
+func getLiteral(prefix string) (fn LiteralFunc, ok bool) {
+	literalsMutex.RLock()
+	defer literalsMutex.RUnlock()
+
+	fn, ok = literals[prefix]
+
+	return
+}
+
+// isBuiltinLiteral reports whether the literal is registered and has not been replaced
+func isBuiltinLiteral(prefix string) bool {
+	literalsMutex.RLock()
+	defer literalsMutex.RUnlock()
+
+	_, ok := literals[prefix]
+
+	return ok && !registeredLiterals[prefix]
+}
+
+// dateTimeLayouts are the accepted datetime literal layouts. Fractional seconds are always accepted,
+// dates without offset are UTC unless the DataState has a timezone (see WithTimezone).
+var dateTimeLayouts = []string{
+	TimeLayout + "Z07:00",
+	TimeLayout + "Z0700",
+	TimeLayout,
+	"2006-01-02T15:04:05Z07:00",
+	"2006-01-02T15:04:05Z0700",
+	"2006-01-02T15:04:05",
+	"2006-01-02",
+}
+
+func parseDateTime(text string) (interface{}, error) {
+	return parseDateTimeIn(text, time.UTC)
+}
+
+// parseDateTimeIn parses a datetime literal, dates without offset are in loc
+func parseDateTimeIn(text string, loc *time.Location) (value interface{}, err error) {
+
+	for _, layout := range dateTimeLayouts {
+		var t time.Time
+		if t, err = time.ParseInLocation(layout, text, loc); err == nil {
+			return t, nil
+		}
+	}
+
+	return
+}
+
+var guidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// parseGUID validates a guid literal and keeps it as a string
+func parseGUID(text string) (interface{}, error) {
+	if !guidPattern.MatchString(text) {
+		return nil, errors.New("invalid guid")
+	}
+
+	return text, nil
+}
+
+func parseObjectID(text string) (interface{}, error) {
+	if !bson.IsObjectIdHex(text) {
+		return nil, errors.New("invalid ObjectId")
+	}
+
+	return bson.ObjectIdHex(text), nil
+}
+
+// numberPattern is the decimal syntax of numbers, unlike strconv.ParseFloat it rejects NaN, Inf and hex floats
+var numberPattern = regexp.MustCompile(`^[-+]?([0-9]+(\.[0-9]*)?|\.[0-9]+)([eE][-+]?[0-9]+)?$`)
+
+// parseWord converts a bare literal: true, false, null, undefined, integers (int64) and numbers (float64)
+func parseWord(word string) (interface{}, error) {
+
+	switch word {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "null", "undefined":
+		return nil, nil
+	}
+
+	if !numberPattern.MatchString(word) {
+		return nil, errors.New("not a number")
+	}
+
+	if i, err := strconv.ParseInt(word, 10, 64); err == nil {
+		return i, nil
+	}
+
+	return strconv.ParseFloat(word, 64)
+}
@@ -0,0 +1,293 @@
+package kendo
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// OperatorFunc compiles a filter to a MongoDB query document, e.g. {"price": {"$gt": 10}}.
+// The DataState gives access to its options, such as the collation.
+type OperatorFunc func(d *DataState, f *FilterDescriptor) (bson.M, error)
+
+var (
+	operatorsMutex sync.RWMutex
+	operators      = map[string]OperatorFunc{
+		"eq":               eqOperator,
+		"ne":               neOperator,
+		"neq":              neOperator,
+		"isnull":           isNullOperator,
+		"isnotnull":        isNotNullOperator,
+		"lt":               compareOperator("$lt"),
+		"lte":              compareOperator("$lte"),
+		"gt":               compareOperator("$gt"),
+		"gte":              compareOperator("$gte"),
+		"startswith":       patternOperator("^%s", false),
+		"endswith":         patternOperator("%s$", false),
+		"contains":         patternOperator("%s", false),
+		"doesnotstartwith": patternOperator("^%s", true),
+		"doesnotendwith":   patternOperator("%s$", true),
+		"doesnotcontain":   patternOperator("%s", true),
+		"in":               listOperator("$in"),
+		"notin":            listOperator("$nin"),
+		"isempty":          isEmptyOperator,
+		"isnotempty":       isNotEmptyOperator,
+		"isnullorempty":    isNullOrEmptyOperator,
+		"isnotnullorempty": isNotNullOrEmptyOperator,
+		"any":              anyOperator,
+		"all":              allOperator,
+		"size":             sizeOperator,
+	}
+	registered = map[string]bool{} // operators registered or replaced by RegisterOperator
+)
+
+// RegisterOperator registers a filter operator, replacing any existing one, built-ins included.
+// For example RegisterOperator("hastag", ...) compiles filters such as tags~hastag~'go'.
+func RegisterOperator(name string, fn OperatorFunc) {
+	operatorsMutex.Lock()
+	defer operatorsMutex.Unlock()
+
+	operators[name] = fn
+	registered[name] = true
+}
+
+func getOperator(name string) (fn OperatorFunc, ok bool) {
+	operatorsMutex.RLock()
+	defer operatorsMutex.RUnlock()
+
+	fn, ok = operators[name]
+
+	return
+}
+
+// isBuiltinOperator reports whether the operator is registered and has not been replaced
+func isBuiltinOperator(name string) bool {
+	operatorsMutex.RLock()
+	defer operatorsMutex.RUnlock()
+
+	_, ok := operators[name]
+
+	return ok && !registered[name]
+}
+
+// checkOperators returns an UnknownOperatorError for the first filter using an unregistered operator,
+// or a ParseError for a sub-filter value of an operator other than any and all or an invalid size.
+// The size is converted to an int64.
+func (d *DataState) checkOperators() error {
+
+	return walkLeaves(&d.Filter, "", func(path string, f *FilterDescriptor) error {
+		if _, ok := getOperator(f.Operator); !ok {
+			return &UnknownOperatorError{
+				Field:    path,
+				Operator: f.Operator,
+			}
+		}
+		if _, ok := f.Value.(Filter); ok && f.Operator != "any" && f.Operator != "all" {
+			return &ParseError{
+				Param:  "filter",
+				Reason: fmt.Sprintf("operator %q of field %s does not take a sub-filter", f.Operator, path),
+			}
+		}
+		if f.Operator == "size" && isBuiltinOperator("size") {
+			size, err := toInt(f.Value)
+			if err != nil || size.(int64) < 0 {
+				return &ParseError{
+					Param:  "filter",
+					Reason: fmt.Sprintf("operator size of field %s expects a non-negative integer, got %v", path, f.Value),
+					Err:    err,
+				}
+			}
+			f.Value = size
+		}
+		return nil
+	})
+}
+
+func eqOperator(d *DataState, f *FilterDescriptor) (bson.M, error) {
+	if start, end, ok := d.dayRange(f); ok {
+		return bson.M{f.Field: bson.M{"$gte": start, "$lt": end}}, nil
+	}
+	if f.matchCase(d) {
+		return bson.M{f.Field: f.Value}, nil
+	}
+
+	return bson.M{f.Field: f.regex(fmt.Sprintf("^%s$", f.pattern()))}, nil
+}
+
+func neOperator(d *DataState, f *FilterDescriptor) (bson.M, error) {
+	if start, end, ok := d.dayRange(f); ok {
+		return bson.M{f.Field: bson.M{"$not": bson.M{"$gte": start, "$lt": end}}}, nil
+	}
+	if f.matchCase(d) {
+		return bson.M{f.Field: bson.M{"$ne": f.Value}}, nil
+	}
+
+	return bson.M{f.Field: f.notRegex(fmt.Sprintf("^%s$", f.pattern()))}, nil
+}
+
+// nullType matches null values but not missing fields
+var nullType = bson.M{"$type": "null"}
+
+func isNullOperator(d *DataState, f *FilterDescriptor) (bson.M, error) {
+	if d.nullSemantics.StrictNull {
+		return bson.M{f.Field: nullType}, nil
+	}
+
+	return bson.M{f.Field: nil}, nil
+}
+
+func isNotNullOperator(d *DataState, f *FilterDescriptor) (bson.M, error) {
+	if d.nullSemantics.StrictNull {
+		return bson.M{f.Field: bson.M{"$not": nullType}}, nil
+	}
+
+	return bson.M{f.Field: bson.M{"$ne": nil}}, nil
+}
+
+// emptyValues returns the values matched by isempty
+func (d *DataState) emptyValues() []interface{} {
+	if d.nullSemantics.EmptyArrays {
+		return []interface{}{"", []interface{}{}}
+	}
+
+	return []interface{}{""}
+}
+
+func isEmptyOperator(d *DataState, f *FilterDescriptor) (bson.M, error) {
+	if d.nullSemantics.EmptyArrays {
+		return bson.M{f.Field: bson.M{"$in": d.emptyValues()}}, nil
+	}
+
+	return bson.M{f.Field: ""}, nil
+}
+
+func isNotEmptyOperator(d *DataState, f *FilterDescriptor) (bson.M, error) {
+	if d.nullSemantics.EmptyArrays {
+		return bson.M{f.Field: bson.M{"$nin": d.emptyValues()}}, nil
+	}
+
+	return bson.M{f.Field: bson.M{"$ne": ""}}, nil
+}
+
+func isNullOrEmptyOperator(d *DataState, f *FilterDescriptor) (bson.M, error) {
+	if d.nullSemantics.StrictNull { // $type cannot be used in $in
+		return bson.M{
+			"$or": []bson.M{
+				{f.Field: nullType},
+				{f.Field: bson.M{"$in": d.emptyValues()}},
+			},
+		}, nil
+	}
+
+	return bson.M{f.Field: bson.M{"$in": append([]interface{}{nil}, d.emptyValues()...)}}, nil
+}
+
+func isNotNullOrEmptyOperator(d *DataState, f *FilterDescriptor) (bson.M, error) {
+	if d.nullSemantics.StrictNull {
+		return bson.M{f.Field: bson.M{"$not": nullType, "$nin": d.emptyValues()}}, nil
+	}
+
+	return bson.M{f.Field: bson.M{"$nin": append([]interface{}{nil}, d.emptyValues()...)}}, nil
+}
+
+// anyOperator matches arrays with an element matching the sub-filter, fields of the sub-filter
+// being relative to the element, or arrays containing one of the values
+func anyOperator(d *DataState, f *FilterDescriptor) (bson.M, error) {
+
+	sub, ok := f.Value.(Filter)
+	if !ok {
+		return bson.M{f.Field: bson.M{"$in": f.list(d, listValue(f.Value)...)}}, nil
+	}
+
+	filter, err := withPrefix(sub, f.getPath()+".").filter(d)
+	if err != nil {
+		return nil, err
+	}
+
+	return bson.M{f.Field: bson.M{"$elemMatch": filter}}, nil
+}
+
+// allOperator matches arrays whose elements all match the sub-filter, empty arrays included,
+// or arrays containing all the values
+func allOperator(d *DataState, f *FilterDescriptor) (bson.M, error) {
+
+	sub, ok := f.Value.(Filter)
+	if !ok {
+		return bson.M{f.Field: bson.M{"$all": f.list(d, listValue(f.Value)...)}}, nil
+	}
+
+	filter, err := withPrefix(sub, f.getPath()+".").filter(d)
+	if err != nil {
+		return nil, err
+	}
+
+	// no element does not match
+	return bson.M{
+		f.Field: bson.M{
+			"$not": bson.M{
+				"$elemMatch": bson.M{
+					"$nor": []bson.M{filter},
+				},
+			},
+		},
+	}, nil
+}
+
+// sizeOperator matches arrays with the number of elements of the value, an int64 (see checkOperators)
+func sizeOperator(d *DataState, f *FilterDescriptor) (bson.M, error) {
+	return bson.M{f.Field: bson.M{"$size": f.Value}}, nil
+}
+
+// compareOperator returns a comparison operator such as $lt
+func compareOperator(operator string) OperatorFunc {
+	return func(d *DataState, f *FilterDescriptor) (bson.M, error) {
+		if start, end, ok := d.dayRange(f); ok {
+			days := map[string]bson.M{
+				"$lt":  {"$lt": start},
+				"$lte": {"$lt": end},
+				"$gt":  {"$gte": end},
+				"$gte": {"$gte": start},
+			}
+			return bson.M{f.Field: days[operator]}, nil
+		}
+
+		return bson.M{f.Field: bson.M{operator: f.Value}}, nil
+	}
+}
+
+// dayRange returns the start of the day of the value, in the timezone of the DataState,
+// and the start of the next day if the field is date-only (FieldDateOnly)
+func (d *DataState) dayRange(f *FilterDescriptor) (start time.Time, end time.Time, ok bool) {
+
+	t, isTime := f.Value.(time.Time)
+	if !isTime || d.schema[f.getPath()] != FieldDateOnly {
+		return
+	}
+
+	loc := d.getLocation()
+	t = t.In(loc)
+	start = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+
+	return start, start.AddDate(0, 0, 1), true
+}
+
+// patternOperator returns a string operator matching, or not, the escaped value formatted with format
+func patternOperator(format string, not bool) OperatorFunc {
+	return func(d *DataState, f *FilterDescriptor) (bson.M, error) {
+		pattern := fmt.Sprintf(format, f.pattern())
+		if not {
+			return bson.M{f.Field: f.notRegex(pattern)}, nil
+		}
+
+		return bson.M{f.Field: f.regex(pattern)}, nil
+	}
+}
+
+// listOperator returns a list operator such as $in
+func listOperator(operator string) OperatorFunc {
+	return func(d *DataState, f *FilterDescriptor) (bson.M, error) {
+		return bson.M{f.Field: bson.M{operator: f.list(d, listValue(f.Value)...)}}, nil
+	}
+}
@@ -1,26 +1,39 @@
 package kendo
 
 import (
+	"mime"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/globalsign/mgo"
 	"github.com/globalsign/mgo/bson"
 )
 
 const (
-	TimeLayout      = "2006-01-02T15-04-05"
-	TokensPerFilter = 4
+	TimeLayout = "2006-01-02T15-04-05"
 )
 
-// NewDataStateFromRequest creates a *DataState from the query parameters of the request
+// NewDataStateFromRequest creates a *DataState from the query parameters of the request.
+// JSON (application/json) and form (application/x-www-form-urlencoded) bodies are also supported,
+// and both the aspnetmvc-ajax (filter=a~eq~1) and jQuery (filter[filters][0][field]=a) formats are detected.
 func NewDataStateFromRequest(request *http.Request) (dataState *DataState, err error) {
 
-	values, err := url.ParseQuery(request.URL.RawQuery)
-	if err != nil {
-		return
+	var values url.Values
+	switch mediaType(request) {
+	case "application/json":
+		return NewDataStateFromJSON(request.Body)
+	case "application/x-www-form-urlencoded":
+		if err = request.ParseForm(); err != nil {
+			return nil, &ParseError{Param: "body", Reason: err.Error(), Err: err}
+		}
+		values = request.Form
+	default:
+		if values, err = url.ParseQuery(request.URL.RawQuery); err != nil {
+			return nil, &ParseError{Param: "query", Reason: err.Error(), Err: err}
+		}
 	}
 
 	dataState = new(DataState)
@@ -45,8 +58,103 @@ func (d *DataState) WithPreprocessing(preprocessing []bson.M) {
 	d.preprocessing = preprocessing
 }
 
+// WithTiebreaker sets the unique field appended to every sort so paging is deterministic,
+// overriding DefaultTiebreaker. An empty field disables the tiebreaker.
+func (d *DataState) WithTiebreaker(field string) {
+	d.tiebreaker = &field
+}
+
+// WithCollation sets the collation of the aggregation. With a case insensitive collation
+// (e.g. &mgo.Collation{Locale: "en", Strength: 2}) equality filters ignoring case are done
+// by MongoDB, which can use an index with the same collation, instead of a regular expression.
+func (d *DataState) WithCollation(collation *mgo.Collation) {
+	d.collation = collation
+}
+
+// WithNullSemantics sets how isnull, isempty, isnullorempty and their negations treat
+// missing fields and empty arrays
+func (d *DataState) WithNullSemantics(semantics NullSemantics) {
+	d.nullSemantics = semantics
+}
+
+// WithTimezone sets the timezone of the user: datetime values without offset are in loc,
+// Encode formats dates in loc and date-only fields (FieldDateOnly) match the days of loc.
+// The default is UTC.
+func (d *DataState) WithTimezone(loc *time.Location) {
+	d.location = loc
+}
+
+func (d *DataState) getLocation() *time.Location {
+	if d.location != nil {
+		return d.location
+	}
+
+	return time.UTC
+}
+
+// Parse fills the DataState descriptors from the request it was created from.
+// It is called by Apply unless called beforehand, which gives access to the parsed state:
+// the descriptors can then be changed before Apply.
+func (d *DataState) Parse() error {
+	if err := d.parse(); err != nil {
+		return err
+	}
+	d.parsed = true
+
+	return nil
+}
+
 func (d *DataState) parse() (err error) {
 
+	form, err := isFormEncoded(d.values)
+	if err != nil {
+		return
+	}
+
+	switch {
+	case d.request != nil:
+		err = d.parseRequest(d.request)
+	case form:
+		err = d.parseForm()
+	default:
+		err = d.parseQuery()
+	}
+	if err != nil {
+		return
+	}
+
+	if err = d.checkLimits(); err != nil {
+		return
+	}
+
+	if err = d.checkOperators(); err != nil {
+		return
+	}
+
+	if err = d.checkAggregates(); err != nil {
+		return
+	}
+
+	if err = d.checkPolicies(); err != nil {
+		return
+	}
+
+	return d.coerceFilter()
+}
+
+func (d *DataState) parseForm() (err error) {
+
+	request, err := newFormRequest(d.values)
+	if err != nil {
+		return
+	}
+
+	return d.parseRequest(request)
+}
+
+// parseQuery parses the aspnetmvc-ajax parameters
+func (d *DataState) parseQuery() (err error) {
+
 	if err = d.parsePage(); err != nil {
 		return
 	}
@@ -59,27 +167,44 @@ func (d *DataState) parse() (err error) {
 		return
 	}
 
-	d.parseSortDescriptors()
-	d.parseGroupDescriptors()
-	d.parseAggregateDescriptors()
+	if err = d.parseSortDescriptors(); err != nil {
+		return
+	}
+
+	if err = d.parseGroupDescriptors(); err != nil {
+		return
+	}
+
+	if search := d.values.Get("search"); search != "" {
+		d.Search = search
+	}
+
+	err = d.parseAggregateDescriptors()
 
 	return
 }
 
-func (d *DataState) parseAggregateDescriptors() {
-	aggregrate := d.values.Get("aggregate")
-	if aggregrate == "" {
+func (d *DataState) parseAggregateDescriptors() (err error) {
+	aggregate := d.values.Get("aggregate")
+	if aggregate == "" {
+		return
+	}
+
+	pairs, err := splitPairs("aggregate", aggregate)
+	if err != nil {
 		return
 	}
 
-	tokens := tokenize(aggregrate, "~")
-	aggregates := make([]AggregateDescriptor, len(tokens))
-	for i, t := range tokens {
-		values := tokenize(t, "-")
-		aggregates[i].Field = d.replaceField(values[0])
-		aggregates[i].Aggregate = values[1]
+	aggregates := make([]AggregateDescriptor, len(pairs))
+	for i, p := range pairs {
+		aggregates[i] = AggregateDescriptor{
+			Field:     d.replaceField(p.field),
+			Aggregate: p.value,
+		}
 	}
 	d.Aggregates = aggregates
+
+	return
 }
 
 func (d *DataState) parseFilterDescriptors() (err error) {
@@ -88,53 +213,40 @@ func (d *DataState) parseFilterDescriptors() (err error) {
 		return
 	}
 
-	tokens := tokenize(filter, "~")
-	nbTokens := len(tokens)
-	nbFilters := (nbTokens / TokensPerFilter) + 1
-	filters := make([]FilterDescriptor, nbFilters)
-	for i := 0; i < nbTokens; i += TokensPerFilter {
-		idx := i / TokensPerFilter
-
-		var value interface{}
-		value, err = toValue(tokens[i+2])
-		if err != nil {
-			return
-		}
-
-		filters[idx] = FilterDescriptor{
-			Field:    d.replaceField(tokens[i]),
-			Operator: tokens[i+1],
-			Value:    value,
-		}
+	composite, err := parseFilter(filter, d.replaceField, d.getLocation())
+	if err != nil {
+		return
 	}
 
-	d.Filter.Filters = filters
-	if nbFilters > 1 {
-		d.Filter.Logic = "and" //TODO support "or" logic
-	}
+	d.Filter = *composite
 
 	return
 }
 
-func (d *DataState) parseGroupDescriptors() {
+func (d *DataState) parseGroupDescriptors() (err error) {
 	group := d.values.Get("group")
 	if group == "" {
 		return
 	}
 
-	tokens := tokenize(group, "~")
-	groups := make([]GroupDescriptor, len(tokens))
-	for i, t := range tokens {
-		group := tokenize(t, "-")
-		field := d.replaceField(group[0])
-		direction := group[1]
+	pairs, err := splitPairs("group", group)
+	if err != nil {
+		return
+	}
+
+	groups := make([]GroupDescriptor, len(pairs))
+	for i, p := range pairs {
+		if err = checkDir("group", p.value, p.offset+len(p.field)+1); err != nil {
+			return
+		}
 		groups[i] = GroupDescriptor{
-			Field: field,
-			Dir:   direction,
+			Field: d.replaceField(p.field),
+			Dir:   p.value,
 		}
 	}
-
 	d.Group = groups
+
+	return
 }
 
 func (d *DataState) parsePage() (err error) {
@@ -143,7 +255,7 @@ func (d *DataState) parsePage() (err error) {
 		return
 	}
 
-	d.Page, err = strconv.Atoi(page)
+	d.Page, err = parseCount("page", page)
 
 	return
 }
@@ -154,26 +266,35 @@ func (d *DataState) parsePageSize() (err error) {
 		return
 	}
 
-	d.PageSize, err = strconv.Atoi(size)
+	d.PageSize, err = parseCount("pageSize", size)
 
 	return
 }
 
-func (d *DataState) parseSortDescriptors() {
+func (d *DataState) parseSortDescriptors() (err error) {
 	sort := d.values.Get("sort")
 	if sort == "" {
 		return
 	}
 
-	s := tokenize(sort, "-")
-	if len(s) >= 2 { //id-asc
-		field := d.replaceField(s[0])
-		direction := s[1]
-		d.Sort = append(d.Sort, SortDescriptor{
-			Field: field,
-			Dir:   direction,
-		})
+	pairs, err := splitPairs("sort", sort)
+	if err != nil {
+		return
 	}
+
+	sorts := make([]SortDescriptor, len(pairs))
+	for i, p := range pairs {
+		if err = checkDir("sort", p.value, p.offset+len(p.field)+1); err != nil {
+			return
+		}
+		sorts[i] = SortDescriptor{
+			Field: d.replaceField(p.field),
+			Dir:   p.value,
+		}
+	}
+	d.Sort = sorts
+
+	return
 }
 
 func (d *DataState) replaceField(field string) (replaced string) {
@@ -186,27 +307,72 @@ func (d *DataState) replaceField(field string) (replaced string) {
 	return
 }
 
-func tokenize(s string, sep string) (tokens []string) {
+// mediaType returns the media type of the request body, or an empty string if there is no body
+func mediaType(request *http.Request) string {
+	if request.Body == nil || request.Body == http.NoBody {
+		return ""
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(request.Header.Get("Content-Type"))
+
+	return mediaType
+}
+
+// pair is an item of a "field-value~field-value" parameter such as sort=name-asc~age-desc
+type pair struct {
+	field  string
+	value  string
+	offset int
+}
 
-	i := strings.Index(s, "(")
-	j := strings.Index(s, ")")
+func splitPairs(param string, s string) (pairs []pair, err error) {
+
+	offset := 0
+	for _, t := range strings.Split(s, "~") {
+		i := strings.LastIndex(t, "-") // fields may contain dashes
+		if i <= 0 || i == len(t)-1 {
+			return nil, &ParseError{
+				Param:  param,
+				Token:  t,
+				Offset: offset,
+				Reason: `expected "field-value"`,
+			}
+		}
+		pairs = append(pairs, pair{
+			field:  t[:i],
+			value:  t[i+1:],
+			offset: offset,
+		})
+		offset += len(t) + 1
+	}
+
+	return
+}
 
-	if i != -1 && j != 1 {
-		s = s[i+1 : j]
+func checkDir(param string, dir string, offset int) error {
+	if dir != "asc" && dir != "desc" {
+		return &ParseError{
+			Param:  param,
+			Token:  dir,
+			Offset: offset,
+			Reason: `expected "asc" or "desc"`,
+		}
 	}
 
-	return strings.Split(s, sep)
+	return nil
 }
 
-func toValue(s string) (value interface{}, err error) {
+// parseCount parses a positive integer parameter such as page or pageSize
+func parseCount(param string, s string) (i int, err error) {
 
-	s = strings.TrimSuffix(s, "'")
-	if d := strings.TrimPrefix(s, "datetime'"); d != s {
-		value, err = time.Parse(TimeLayout, d)
-	} else if strings.HasPrefix(s, "'") == false {
-		value, err = strconv.ParseFloat(s, 64)
-	} else {
-		value = strings.TrimPrefix(s, "'")
+	i, err = strconv.Atoi(s)
+	if err != nil || i < 0 {
+		return 0, &ParseError{
+			Param:  param,
+			Token:  s,
+			Reason: "expected a positive integer",
+			Err:    err,
+		}
 	}
 
 	return
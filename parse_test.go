@@ -1,11 +1,15 @@
 package kendo
 
 import (
+	"encoding/json"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"reflect"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/globalsign/mgo/bson"
 )
@@ -41,6 +45,387 @@ func TestNewDataStateFromRequest2(t *testing.T) {
 	})
 }
 
+func TestNewDataStateFromJSON(t *testing.T) {
+	body := `{
+		"take": 20, "skip": 40, "page": 3, "pageSize": 20,
+		"sort": [{"field": "name", "dir": "desc"}],
+		"filter": {
+			"logic": "and",
+			"filters": [
+				{"field": "price", "operator": "gt", "value": 10},
+				{"field": "price", "operator": "lt", "value": 49.5, "ignoreCase": false},
+				{"field": "status", "operator": "in", "value": ["open", 2]},
+				{
+					"logic": "or",
+					"filters": [
+						{"field": "active", "operator": "eq", "value": true},
+						{"field": "due", "operator": "lt", "value": "2024-03-01T10:15:30.000Z", "ignoreCase": true}
+					]
+				}
+			]
+		},
+		"group": [{"field": "owner", "dir": "asc", "aggregates": [{"field": "price", "aggregate": "max"}]}],
+		"aggregate": [{"field": "price", "aggregate": "sum"}],
+		"search": "bob"
+	}`
+
+	t.Run("Should parse the DataSourceRequest JSON into the DataState", func(t *testing.T) {
+		d, err := NewDataStateFromJSON(strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("NewDataStateFromJSON() error = %v", err)
+		}
+		if err = d.parse(); err != nil {
+			t.Fatalf("DataState.parse() error = %v", err)
+		}
+
+		want := DataState{
+			Page:     3,
+			PageSize: 20,
+			Sort: []SortDescriptor{
+				{Field: "name", Dir: "desc"},
+			},
+			Filter: CompositeFilterDescriptor{
+				Logic: "and",
+				Filters: []Filter{
+					&FilterDescriptor{Field: "price", Operator: "gt", Value: int64(10), IgnoreCase: true},
+					&FilterDescriptor{Field: "price", Operator: "lt", Value: 49.5},
+					&FilterDescriptor{Field: "status", Operator: "in", Value: []interface{}{"open", int64(2)}, IgnoreCase: true},
+					&CompositeFilterDescriptor{
+						Logic: "or",
+						Filters: []Filter{
+							&FilterDescriptor{Field: "active", Operator: "eq", Value: true, IgnoreCase: true},
+							&FilterDescriptor{
+								Field:      "due",
+								Operator:   "lt",
+								Value:      time.Date(2024, 3, 1, 10, 15, 30, 0, time.UTC),
+								IgnoreCase: true,
+							},
+						},
+					},
+				},
+			},
+			Group: []GroupDescriptor{
+				{
+					Field: "owner",
+					Dir:   "asc",
+					Aggregates: []AggregateDescriptor{
+						{Field: "price", Aggregate: "max"},
+					},
+				},
+			},
+			Aggregates: []AggregateDescriptor{
+				{Field: "price", Aggregate: "sum"},
+			},
+			Search: "bob",
+		}
+		want.request = d.request
+
+		if !reflect.DeepEqual(*d, want) {
+			t.Errorf("DataState.parse() = %+v, want %+v", *d, want)
+		}
+	})
+
+	t.Run("Should compute the page from take and skip", func(t *testing.T) {
+		d, _ := NewDataStateFromJSON(strings.NewReader(`{"take": 10, "skip": 30}`))
+		d.parse()
+
+		if d.Page != 4 || d.PageSize != 10 {
+			t.Errorf("DataState.parse() page = %v, pageSize = %v, want 4, 10", d.Page, d.PageSize)
+		}
+	})
+
+	t.Run("Should keep a skip that is not a multiple of take", func(t *testing.T) {
+		for _, body := range []string{
+			`{"take": 10, "skip": 5}`,
+			`{"take": 10, "skip": 5, "page": 1, "pageSize": 10}`,
+		} {
+			d, _ := NewDataStateFromJSON(strings.NewReader(body))
+			if err := d.parse(); err != nil {
+				t.Fatalf("DataState.parse() error = %v", err)
+			}
+
+			want := []bson.M{{"$skip": 5}, {"$limit": 10}}
+			if got := d.getPaging(); !reflect.DeepEqual(got, want) {
+				t.Errorf("DataState.getPaging() %s = %v, want %v", body, got, want)
+			}
+		}
+	})
+
+	t.Run("Should replace fields", func(t *testing.T) {
+		d, _ := NewDataStateFromJSON(strings.NewReader(body))
+		d.WithReplacements(map[string]string{
+			"price": "amount",
+			"owner": "ownerId",
+		})
+		d.parse()
+
+		gotFields := []string{
+			d.Filter.Filters[0].(*FilterDescriptor).Field,
+			d.Group[0].Field,
+			d.Group[0].Aggregates[0].Field,
+			d.Aggregates[0].Field,
+		}
+		wantFields := []string{"amount", "ownerId", "amount", "amount"}
+		if !reflect.DeepEqual(gotFields, wantFields) {
+			t.Errorf("DataState.parse() fields = %v, want %v", gotFields, wantFields)
+		}
+
+		if field := d.request.Filter.Filters[0].(*FilterDescriptor).Field; field != "price" {
+			t.Errorf("DataState.parse() modified the request field to %v", field)
+		}
+	})
+
+	t.Run("Should parse sub-filters of array operators", func(t *testing.T) {
+		d, err := NewDataStateFromJSON(strings.NewReader(`{"filter": {"logic": "and", "filters": [
+			{"field": "items", "operator": "any", "value": {"field": "qty", "operator": "gt", "value": 5}}
+		]}}`))
+		if err != nil {
+			t.Fatalf("NewDataStateFromJSON() error = %v", err)
+		}
+		if err = d.parse(); err != nil {
+			t.Fatalf("DataState.parse() error = %v", err)
+		}
+
+		wantValues := []interface{}{
+			&CompositeFilterDescriptor{
+				Logic: "and",
+				Filters: []Filter{
+					&FilterDescriptor{Field: "qty", Operator: "gt", Value: int64(5), IgnoreCase: true},
+				},
+			},
+		}
+		gotValues := []interface{}{}
+		for _, f := range d.Filter.leaves() {
+			gotValues = append(gotValues, f.Value)
+		}
+		if !reflect.DeepEqual(gotValues, wantValues) {
+			t.Errorf("DataState.parse() = %v, want %v", gotValues, wantValues)
+		}
+	})
+
+	t.Run("Should be used by NewDataStateFromRequest for JSON bodies", func(t *testing.T) {
+		request := httptest.NewRequest(http.MethodPost, "/?page=1", strings.NewReader(body))
+		request.Header.Set("Content-Type", "application/json; charset=utf-8")
+
+		d, err := NewDataStateFromRequest(request)
+		if err != nil {
+			t.Fatalf("NewDataStateFromRequest() error = %v", err)
+		}
+		d.parse()
+
+		if d.Page != 3 || len(d.Filter.Filters) != 4 {
+			t.Errorf("NewDataStateFromRequest() = %+v, want the JSON body state", d)
+		}
+	})
+
+	t.Run("Should not convert the values of pattern operators to dates", func(t *testing.T) {
+		d, err := NewDataStateFromJSON(strings.NewReader(
+			`{"filter": {"filters": [{"field": "log", "operator": "doesnotcontain", "value": "2024-03-01T10:15:30Z"}]}}`))
+		if err != nil {
+			t.Fatalf("NewDataStateFromJSON() error = %v", err)
+		}
+		if err = d.parse(); err != nil {
+			t.Fatalf("DataState.parse() error = %v", err)
+		}
+
+		if value := d.Filter.leaves()[0].Value; value != "2024-03-01T10:15:30Z" {
+			t.Errorf("DataState.parse() value = %#v, want the string", value)
+		}
+	})
+
+	t.Run("Should return error if the JSON is invalid", func(t *testing.T) {
+		if _, err := NewDataStateFromJSON(strings.NewReader(`{"filter": [`)); err == nil {
+			t.Errorf("NewDataStateFromJSON() error = %v, wantErr", err)
+		}
+	})
+}
+
+func TestDataState_parseForm(t *testing.T) {
+	query := "take=10&skip=20&page=3&pageSize=10" +
+		"&sort[0][field]=name&sort[0][dir]=asc&sort[1][field]=age&sort[1][dir]=desc" +
+		"&filter[logic]=and" +
+		"&filter[filters][0][field]=x&filter[filters][0][operator]=eq&filter[filters][0][value]=1&filter[filters][0][ignoreCase]=false" +
+		"&filter[filters][1][logic]=or" +
+		"&filter[filters][1][filters][0][field]=y&filter[filters][1][filters][0][operator]=contains&filter[filters][1][filters][0][value]=a&filter[filters][1][filters][0][ignoreCase]=true" +
+		"&filter[filters][1][filters][1][field]=y&filter[filters][1][filters][1][operator]=eq&filter[filters][1][filters][1][value]=b" +
+		"&group[0][field]=owner&group[0][dir]=desc&group[0][aggregates][0][field]=price&group[0][aggregates][0][aggregate]=sum" +
+		"&aggregate[0][field]=price&aggregate[0][aggregate]=average" +
+		"&search=bob"
+
+	wantDataState := DataState{
+		Page:     3,
+		PageSize: 10,
+		Sort: []SortDescriptor{
+			{Field: "name", Dir: "asc"},
+			{Field: "age", Dir: "desc"},
+		},
+		Filter: CompositeFilterDescriptor{
+			Logic: "and",
+			Filters: []Filter{
+				&FilterDescriptor{Field: "x", Operator: "eq", Value: "1"},
+				&CompositeFilterDescriptor{
+					Logic: "or",
+					Filters: []Filter{
+						&FilterDescriptor{Field: "y", Operator: "contains", Value: "a", IgnoreCase: true},
+						&FilterDescriptor{Field: "y", Operator: "eq", Value: "b", IgnoreCase: true},
+					},
+				},
+			},
+		},
+		Group: []GroupDescriptor{
+			{
+				Field: "owner",
+				Dir:   "desc",
+				Aggregates: []AggregateDescriptor{
+					{Field: "price", Aggregate: "sum"},
+				},
+			},
+		},
+		Aggregates: []AggregateDescriptor{
+			{Field: "price", Aggregate: "average"},
+		},
+		Search: "bob",
+	}
+
+	t.Run("Should parse the jQuery DataSource query string", func(t *testing.T) {
+		u, _ := url.Parse("https://test.test?" + query)
+		request := new(http.Request)
+		request.URL = u
+
+		d, err := NewDataStateFromRequest(request)
+		if err != nil {
+			t.Fatalf("NewDataStateFromRequest() error = %v", err)
+		}
+		if err = d.parse(); err != nil {
+			t.Fatalf("DataState.parse() error = %v", err)
+		}
+
+		want := wantDataState
+		want.values = d.values
+		if !reflect.DeepEqual(*d, want) {
+			t.Errorf("DataState.parse() = %+v, want %+v", *d, want)
+		}
+	})
+
+	t.Run("Should parse a form encoded body", func(t *testing.T) {
+		request := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(query))
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		d, err := NewDataStateFromRequest(request)
+		if err != nil {
+			t.Fatalf("NewDataStateFromRequest() error = %v", err)
+		}
+		if err = d.parse(); err != nil {
+			t.Fatalf("DataState.parse() error = %v", err)
+		}
+
+		want := wantDataState
+		want.values = d.values
+		if !reflect.DeepEqual(*d, want) {
+			t.Errorf("DataState.parse() = %+v, want %+v", *d, want)
+		}
+	})
+
+	t.Run("Should parse sub-filter values", func(t *testing.T) {
+		v, _ := url.ParseQuery("filter[filters][0][field]=items&filter[filters][0][operator]=any" +
+			"&filter[filters][0][value][logic]=and" +
+			"&filter[filters][0][value][filters][0][field]=sku&filter[filters][0][value][filters][0][operator]=eq&filter[filters][0][value][filters][0][value]=X" +
+			"&filter[filters][1][field]=items&filter[filters][1][operator]=all" +
+			"&filter[filters][1][value][field]=qty&filter[filters][1][value][operator]=gt&filter[filters][1][value][value]=5")
+		d := DataState{}
+		d.values = v
+
+		if err := d.parse(); err != nil {
+			t.Fatalf("DataState.parse() error = %v", err)
+		}
+
+		wantValues := []interface{}{
+			&CompositeFilterDescriptor{
+				Logic: "and",
+				Filters: []Filter{
+					&FilterDescriptor{Field: "sku", Operator: "eq", Value: "X", IgnoreCase: true},
+				},
+			},
+			&CompositeFilterDescriptor{
+				Logic: "and",
+				Filters: []Filter{
+					&FilterDescriptor{Field: "qty", Operator: "gt", Value: "5", IgnoreCase: true},
+				},
+			},
+		}
+		gotValues := []interface{}{}
+		for _, f := range d.Filter.leaves() {
+			gotValues = append(gotValues, f.Value)
+		}
+		if !reflect.DeepEqual(gotValues, wantValues) {
+			t.Errorf("DataState.parse() = %v, want %v", gotValues, wantValues)
+		}
+	})
+
+	t.Run("Should parse list values", func(t *testing.T) {
+		v, _ := url.ParseQuery("filter[filters][0][field]=x&filter[filters][0][operator]=eq&filter[filters][0][value][]=a&filter[filters][0][value][]=b")
+		d := DataState{}
+		d.values = v
+
+		if err := d.parse(); err != nil {
+			t.Fatalf("DataState.parse() error = %v", err)
+		}
+
+		wantValue := []interface{}{"a", "b"}
+		if got := d.Filter.Filters[0].(*FilterDescriptor).Value; !reflect.DeepEqual(got, wantValue) {
+			t.Errorf("DataState.parse() = %v, want %v", got, wantValue)
+		}
+	})
+
+	t.Run("Should return error on malformed parameters", func(t *testing.T) {
+		for _, query := range []string{
+			"take=ten",
+			"sort[0][field=name",
+			"sort[a][field]=name",
+			"sort[0]=name",
+		} {
+			v, _ := url.ParseQuery(query)
+			d := DataState{}
+			d.values = v
+
+			if err := d.parse(); err == nil {
+				t.Errorf("DataState.parse(%q) error = nil, want err", query)
+			}
+		}
+	})
+
+	t.Run("Should ignore the bracket keys of other parameters", func(t *testing.T) {
+		v, _ := url.ParseQuery("filter=a~eq~1&ids[]=1&ids[]=2")
+		d := DataState{}
+		d.values = v
+
+		if err := d.parse(); err != nil {
+			t.Fatalf("DataState.parse() error = %v", err)
+		}
+
+		want := []Filter{&FilterDescriptor{Field: "a", Operator: "eq", Value: int64(1)}}
+		if !reflect.DeepEqual(d.Filter.Filters, want) {
+			t.Errorf("DataState.parse() = %v, want %v", d.Filter.Filters, want)
+		}
+	})
+
+	t.Run("Should return a ParseError if both formats are used", func(t *testing.T) {
+		for _, query := range []string{
+			"filter=a~eq~1&take=10",
+			"filter=a~eq~1&sort[0][field]=name&sort[0][dir]=asc",
+			"sort=name-asc&filter[filters][0][field]=a&filter[filters][0][operator]=eq&filter[filters][0][value]=1",
+		} {
+			v, _ := url.ParseQuery(query)
+			d := DataState{}
+			d.values = v
+
+			if _, ok := d.parse().(*ParseError); !ok {
+				t.Errorf("DataState.parse(%q) error is not a ParseError", query)
+			}
+		}
+	})
+}
+
 func TestDataState_WithReplacements1(t *testing.T) {
 	t.Run("Should set DataState replacements field", func(t *testing.T) {
 		replacements := map[string]string{
@@ -93,6 +478,17 @@ func TestDataState_WithPreprocessing(t *testing.T) {
 	})
 }
 
+func TestDataState_WithTiebreaker(t *testing.T) {
+	t.Run("Should set DataState tiebreaker field", func(t *testing.T) {
+		d := DataState{}
+		d.WithTiebreaker("code")
+
+		if d.tiebreaker == nil || *d.tiebreaker != "code" {
+			t.Errorf("DataState.WithTiebreaker() = %v, want %v", d.tiebreaker, "code")
+		}
+	})
+}
+
 func TestDataState_parse(t *testing.T) {
 	t.Run("parsePage", func(t *testing.T) {
 		t.Run("Should parse page in DataState values and set Page field", func(t *testing.T) {
@@ -117,10 +513,14 @@ func TestDataState_parse(t *testing.T) {
 
 			err := d.parse()
 
-			if _, ok := err.(*strconv.NumError); !ok {
-				t.Errorf("DataState.parse() error = %v, want NumError", err)
+			parseErr, ok := err.(*ParseError)
+			if !ok {
+				t.Errorf("DataState.parse() error = %v, want ParseError", err)
 				return
 			}
+			if _, ok := parseErr.Err.(*strconv.NumError); !ok {
+				t.Errorf("DataState.parse() error = %v, want NumError", parseErr.Err)
+			}
 		})
 	})
 
@@ -147,10 +547,14 @@ func TestDataState_parse(t *testing.T) {
 
 			err := d.parse()
 
-			if _, ok := err.(*strconv.NumError); !ok {
-				t.Errorf("DataState.parse() error = %v, want NumError", err)
+			parseErr, ok := err.(*ParseError)
+			if !ok {
+				t.Errorf("DataState.parse() error = %v, want ParseError", err)
 				return
 			}
+			if _, ok := parseErr.Err.(*strconv.NumError); !ok {
+				t.Errorf("DataState.parse() error = %v, want NumError", parseErr.Err)
+			}
 		})
 	})
 
@@ -174,6 +578,24 @@ func TestDataState_parse(t *testing.T) {
 			}
 		})
 
+		t.Run("Should parse multiple sorts in order", func(t *testing.T) {
+			v := url.Values{}
+			v.Set("sort", "a-asc~b-desc~owner.first-name-asc")
+			d := DataState{}
+			d.values = v
+
+			d.parse()
+
+			wantSort := []SortDescriptor{
+				{Field: "a", Dir: "asc"},
+				{Field: "b", Dir: "desc"},
+				{Field: "owner.first-name", Dir: "asc"},
+			}
+			if !reflect.DeepEqual(d.Sort, wantSort) {
+				t.Errorf("DataState.parse() = %v, want %v", d.Sort, wantSort)
+			}
+		})
+
 		t.Run("Should replace sort field if the field has a replacement", func(t *testing.T) {
 			v := url.Values{}
 			v.Set("sort", "firstName-asc")
@@ -299,6 +721,35 @@ func TestDataState_parse(t *testing.T) {
 		})
 	})
 
+	t.Run("parseSearch", func(t *testing.T) {
+		t.Run("Should parse search in DataState values and set Search field", func(t *testing.T) {
+			v := url.Values{}
+			v.Set("search", "blue car")
+			d := DataState{}
+			d.values = v
+
+			if err := d.parse(); err != nil {
+				t.Fatalf("DataState.parse() error = %v", err)
+			}
+
+			if d.Search != "blue car" {
+				t.Errorf("DataState.parse() = %v, want %v", d.Search, "blue car")
+			}
+		})
+
+		t.Run("Should keep the Search field without search in DataState values", func(t *testing.T) {
+			d := DataState{Search: "abc"}
+
+			if err := d.parse(); err != nil {
+				t.Fatalf("DataState.parse() error = %v", err)
+			}
+
+			if d.Search != "abc" {
+				t.Errorf("DataState.parse() = %v, want %v", d.Search, "abc")
+			}
+		})
+	})
+
 	t.Run("parseFilterDescriptors", func(t *testing.T) {
 		t.Run("Should parse filter in DataState values and set Filter field", func(t *testing.T) {
 			v := url.Values{}
@@ -308,13 +759,14 @@ func TestDataState_parse(t *testing.T) {
 
 			d.parse()
 
-			wantFilters := []FilterDescriptor{
-				{
-					Field:    "title",
-					Operator: "contains",
-					Value:    "hello",
+			wantFilters := []Filter{
+				&FilterDescriptor{
+					Field:      "title",
+					Operator:   "contains",
+					Value:      "hello",
+					IgnoreCase: true,
 				},
-				{
+				&FilterDescriptor{
 					Field:    "firstName",
 					Operator: "eq",
 					Value:    "world",
@@ -324,5 +776,802 @@ func TestDataState_parse(t *testing.T) {
 				t.Errorf("DataState.parse() = %v, want %v", d.Filter.Filters, wantFilters)
 			}
 		})
+
+		t.Run("Should match equality exactly and patterns ignoring case", func(t *testing.T) {
+			v := url.Values{}
+			v.Set("filter", "name~eq~'John'~and~title~contains~'go'")
+			d := DataState{}
+			d.values = v
+
+			if err := d.parse(); err != nil {
+				t.Fatalf("DataState.parse() error = %v", err)
+			}
+
+			wantFilter := bson.M{
+				"$and": []bson.M{
+					{"name": "John"},
+					{"title": bson.M{"$regex": "go", "$options": "i"}},
+				},
+			}
+			if gotFilter, _ := d.getFilter(); !reflect.DeepEqual(gotFilter, wantFilter) {
+				t.Errorf("DataState.getFilter() = %v, want %v", gotFilter, wantFilter)
+			}
+		})
+
+		t.Run("Should parse nested and/or groups into a filter tree", func(t *testing.T) {
+			v := url.Values{}
+			v.Set("filter", "(status~eq~'open'~or~(due~lt~datetime'2024-01-01T00-00-00'~and~owner~eq~'bob'))")
+			d := DataState{}
+			d.values = v
+
+			if err := d.parse(); err != nil {
+				t.Fatalf("DataState.parse() error = %v", err)
+			}
+
+			wantFilter := CompositeFilterDescriptor{
+				Logic: "or",
+				Filters: []Filter{
+					&FilterDescriptor{
+						Field:    "status",
+						Operator: "eq",
+						Value:    "open",
+					},
+					&CompositeFilterDescriptor{
+						Logic: "and",
+						Filters: []Filter{
+							&FilterDescriptor{
+								Field:    "due",
+								Operator: "lt",
+								Value:    time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+							},
+							&FilterDescriptor{
+								Field:    "owner",
+								Operator: "eq",
+								Value:    "bob",
+							},
+						},
+					},
+				},
+			}
+			if !reflect.DeepEqual(d.Filter, wantFilter) {
+				t.Errorf("DataState.parse() = %v, want %v", d.Filter, wantFilter)
+			}
+		})
+
+		t.Run("Should give and precedence over or", func(t *testing.T) {
+			v := url.Values{}
+			v.Set("filter", "a~eq~1~or~b~eq~2~and~c~eq~3")
+			d := DataState{}
+			d.values = v
+
+			if err := d.parse(); err != nil {
+				t.Fatalf("DataState.parse() error = %v", err)
+			}
+
+			wantFilter := CompositeFilterDescriptor{
+				Logic: "or",
+				Filters: []Filter{
+					&FilterDescriptor{Field: "a", Operator: "eq", Value: int64(1)},
+					&CompositeFilterDescriptor{
+						Logic: "and",
+						Filters: []Filter{
+							&FilterDescriptor{Field: "b", Operator: "eq", Value: int64(2)},
+							&FilterDescriptor{Field: "c", Operator: "eq", Value: int64(3)},
+						},
+					},
+				},
+			}
+			if !reflect.DeepEqual(d.Filter, wantFilter) {
+				t.Errorf("DataState.parse() = %v, want %v", d.Filter, wantFilter)
+			}
+		})
+
+		t.Run("Should wrap a single filter in an and composite", func(t *testing.T) {
+			v := url.Values{}
+			v.Set("filter", "title~eq~'a'")
+			d := DataState{}
+			d.values = v
+			d.replacements = map[string]string{
+				"title": "name",
+			}
+
+			if err := d.parse(); err != nil {
+				t.Fatalf("DataState.parse() error = %v", err)
+			}
+
+			wantFilter := CompositeFilterDescriptor{
+				Logic: "and",
+				Filters: []Filter{
+					&FilterDescriptor{Field: "name", Operator: "eq", Value: "a"},
+				},
+			}
+			if !reflect.DeepEqual(d.Filter, wantFilter) {
+				t.Errorf("DataState.parse() = %v, want %v", d.Filter, wantFilter)
+			}
+		})
+
+		t.Run("Should keep delimiters and escaped quotes inside strings", func(t *testing.T) {
+			v := url.Values{}
+			v.Set("filter", "title~eq~'it''s~a-(test)'")
+			d := DataState{}
+			d.values = v
+
+			if err := d.parse(); err != nil {
+				t.Fatalf("DataState.parse() error = %v", err)
+			}
+
+			want := "it's~a-(test)"
+			if got := d.Filter.Filters[0].(*FilterDescriptor).Value; got != want {
+				t.Errorf("DataState.parse() = %v, want %v", got, want)
+			}
+		})
+
+		t.Run("Should type filter literals", func(t *testing.T) {
+			utc2 := time.FixedZone("", 2*60*60)
+			tests := []struct {
+				literal   string
+				wantValue interface{}
+			}{
+				{"'text'", "text"},
+				{"true", true},
+				{"false", false},
+				{"null", nil},
+				{"undefined", nil},
+				{"42", int64(42)},
+				{"-7", int64(-7)},
+				{"4.5", 4.5},
+				{"1e3", float64(1000)},
+				{"datetime'2024-03-01T10-15-30'", time.Date(2024, 3, 1, 10, 15, 30, 0, time.UTC)},
+				{"datetime'2024-03-01T10-15-30.123'", time.Date(2024, 3, 1, 10, 15, 30, 123000000, time.UTC)},
+				{"datetime'2024-03-01T10-15-30.123+02:00'", time.Date(2024, 3, 1, 10, 15, 30, 123000000, utc2)},
+				{"datetime'2024-03-01T10-15-30+0200'", time.Date(2024, 3, 1, 10, 15, 30, 0, utc2)},
+				{"datetime'2024-03-01T10-15-30Z'", time.Date(2024, 3, 1, 10, 15, 30, 0, time.UTC)},
+				{"datetime'2024-03-01T10:15:30.5Z'", time.Date(2024, 3, 1, 10, 15, 30, 500000000, time.UTC)},
+				{"datetime'2024-03-01'", time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)},
+				{"guid'0f8fad5b-d9cb-469f-a165-70867728950e'", "0f8fad5b-d9cb-469f-a165-70867728950e"},
+				{"objectid'5c4b3c6e9d1f2a0001a1b2c3'", bson.ObjectIdHex("5c4b3c6e9d1f2a0001a1b2c3")},
+				{"['a','b,c']", []interface{}{"a", "b,c"}},
+				{"[1,2.5,null]", []interface{}{int64(1), 2.5, nil}},
+				{"[]", []interface{}{}},
+			}
+
+			for _, tt := range tests {
+				v := url.Values{}
+				v.Set("filter", "field~eq~"+tt.literal)
+				d := DataState{}
+				d.values = v
+
+				if err := d.parse(); err != nil {
+					t.Errorf("DataState.parse(%s) error = %v", tt.literal, err)
+					continue
+				}
+
+				gotValue := d.Filter.Filters[0].(*FilterDescriptor).Value
+				if gotTime, ok := gotValue.(time.Time); ok {
+					if wantTime, ok := tt.wantValue.(time.Time); !ok || !gotTime.Equal(wantTime) {
+						t.Errorf("DataState.parse(%s) = %v, want %v", tt.literal, gotValue, tt.wantValue)
+					}
+					continue
+				}
+				if !reflect.DeepEqual(gotValue, tt.wantValue) {
+					t.Errorf("DataState.parse(%s) = %#v, want %#v", tt.literal, gotValue, tt.wantValue)
+				}
+			}
+		})
+
+		t.Run("Should return err on invalid typed literals", func(t *testing.T) {
+			for _, literal := range []string{"datetime'2024-13-01'", "guid'1234'", "objectid'xyz'", "True", "1.2.3"} {
+				v := url.Values{}
+				v.Set("filter", "field~eq~"+literal)
+				d := DataState{}
+				d.values = v
+
+				if _, ok := d.parse().(*ParseError); !ok {
+					t.Errorf("DataState.parse(%s) error = nil, want ParseError", literal)
+				}
+			}
+		})
+
+		t.Run("Should use registered literals", func(t *testing.T) {
+			RegisterLiteral("upper", func(text string) (interface{}, error) {
+				return strings.ToUpper(text), nil
+			})
+			defer func() {
+				literalsMutex.Lock()
+				delete(literals, "upper")
+				literalsMutex.Unlock()
+			}()
+
+			v := url.Values{}
+			v.Set("filter", "code~eq~upper'abc'")
+			d := DataState{}
+			d.values = v
+
+			if err := d.parse(); err != nil {
+				t.Fatalf("DataState.parse() error = %v", err)
+			}
+
+			if got := d.Filter.Filters[0].(*FilterDescriptor).Value; got != "ABC" {
+				t.Errorf("DataState.parse() = %v, want %v", got, "ABC")
+			}
+		})
+
+		t.Run("Should parse sub-filters of array operators", func(t *testing.T) {
+			v := url.Values{}
+			v.Set("filter", "lines~any~(sku~eq~'X'~and~qty~gt~5)~and~tags~size~2")
+			d := DataState{}
+			d.values = v
+			d.WithReplacements(map[string]string{"lines": "items", "sku": "code"})
+			d.WithSchema(map[string]FieldType{"items.qty": FieldFloat, "tags": FieldString})
+
+			if err := d.parse(); err != nil {
+				t.Fatalf("DataState.parse() error = %v", err)
+			}
+
+			wantFilter := CompositeFilterDescriptor{
+				Logic: "and",
+				Filters: []Filter{
+					&FilterDescriptor{
+						Field:    "items",
+						Operator: "any",
+						Value: &CompositeFilterDescriptor{
+							Logic: "and",
+							Filters: []Filter{
+								&FilterDescriptor{Field: "sku", Operator: "eq", Value: "X"},
+								&FilterDescriptor{Field: "qty", Operator: "gt", Value: float64(5)},
+							},
+						},
+					},
+					&FilterDescriptor{Field: "tags", Operator: "size", Value: int64(2)},
+				},
+			}
+			if !reflect.DeepEqual(d.Filter, wantFilter) {
+				t.Errorf("DataState.parse() = %v, want %v", d.Filter, wantFilter)
+			}
+		})
+
+		t.Run("Should return an UnknownOperatorError with the path of a sub-filter field", func(t *testing.T) {
+			v := url.Values{}
+			v.Set("filter", "items~all~(qty~like~5)")
+			d := DataState{}
+			d.values = v
+
+			err := d.parse()
+
+			if e, ok := err.(*UnknownOperatorError); !ok || e.Field != "items.qty" {
+				t.Errorf("DataState.parse() error = %v, want UnknownOperatorError", err)
+			}
+		})
+
+		t.Run("Should return err on malformed filters", func(t *testing.T) {
+			for _, filter := range []string{
+				"title~eq",
+				"title~eq~'open",
+				"(title~eq~'a'",
+				"title~eq~'a')",
+				"title~eq~'a'~xor~b~eq~'b'",
+				"status~in~['a'",
+				"status~in~['a',]",
+				"status~in~['a'~'b']",
+				"status~in~[['a']]",
+				"status~in~[(a~eq~1)]",
+				"items~any~(sku~eq~'X'",
+				"items~any~()",
+			} {
+				v := url.Values{}
+				v.Set("filter", filter)
+				d := DataState{}
+				d.values = v
+
+				if err := d.parse(); err == nil {
+					t.Errorf("DataState.parse(%q) error = nil, want err", filter)
+				}
+			}
+		})
+
+		t.Run("Should return a ParseError for sub-filters of other operators than any and all", func(t *testing.T) {
+			for _, filter := range []string{
+				"name~eq~(x~eq~1)",
+				"name~contains~(x~eq~1)",
+				"items~any~(sku~in~(x~eq~1))",
+			} {
+				v := url.Values{}
+				v.Set("filter", filter)
+				d := DataState{}
+				d.values = v
+
+				if _, ok := d.parse().(*ParseError); !ok {
+					t.Errorf("DataState.parse(%q) error is not a ParseError", filter)
+				}
+			}
+		})
+
+		t.Run("Should require a non-negative integer size", func(t *testing.T) {
+			for _, filter := range []string{"tags~size~'abc'", "tags~size~-1", "tags~size~1.5", "tags~size~null"} {
+				v := url.Values{}
+				v.Set("filter", filter)
+				d := DataState{}
+				d.values = v
+
+				if _, ok := d.parse().(*ParseError); !ok {
+					t.Errorf("DataState.parse(%q) error is not a ParseError", filter)
+				}
+			}
+
+			v, _ := url.ParseQuery("filter[filters][0][field]=tags&filter[filters][0][operator]=size&filter[filters][0][value]=2")
+			d := DataState{}
+			d.values = v
+			if err := d.parse(); err != nil {
+				t.Fatalf("DataState.parse() error = %v", err)
+			}
+			if value := d.Filter.leaves()[0].Value; value != int64(2) {
+				t.Errorf("DataState.parse() size = %#v, want int64(2)", value)
+			}
+		})
+
+		t.Run("Should parse aggregates with arguments", func(t *testing.T) {
+			v := url.Values{}
+			v.Set("aggregate", "price-percentile(90)~price-countDistinct")
+			d := DataState{}
+			d.values = v
+
+			if err := d.parse(); err != nil {
+				t.Fatalf("DataState.parse() error = %v", err)
+			}
+
+			wantAggregates := []AggregateDescriptor{
+				{Field: "price", Aggregate: "percentile(90)"},
+				{Field: "price", Aggregate: "countDistinct"},
+			}
+			if !reflect.DeepEqual(d.Aggregates, wantAggregates) {
+				t.Errorf("DataState.parse() = %v, want %v", d.Aggregates, wantAggregates)
+			}
+		})
+
+		t.Run("Should return an AggregateError for unknown or invalid aggregates", func(t *testing.T) {
+			for _, aggregate := range []string{
+				"price-mode",
+				"price-percentile",
+				"price-percentile(101)",
+				"price-percentile(a)",
+				"price-sum(1)",
+			} {
+				v := url.Values{}
+				v.Set("aggregate", aggregate)
+				d := DataState{}
+				d.values = v
+
+				if _, ok := d.parse().(*AggregateError); !ok {
+					t.Errorf("DataState.parse(%q) error is not an AggregateError", aggregate)
+				}
+			}
+		})
+	})
+}
+
+func TestDataState_parseErrors(t *testing.T) {
+	t.Run("Should return a positioned ParseError", func(t *testing.T) {
+		tests := []struct {
+			param     string
+			value     string
+			wantError ParseError
+		}{
+			{"filter", "title~eq~'a'~and~due~gt", ParseError{Param: "filter", Offset: 23, Reason: "unexpected end of filter"}},
+			{"filter", "title~eq~'a'~and~(due~gt~1", ParseError{Param: "filter", Offset: 26, Reason: "unexpected end of filter"}},
+			{"filter", "title~eq~'open", ParseError{Param: "filter", Token: "'open", Offset: 9, Reason: "unterminated string"}},
+			{"filter", "title~eq~one", ParseError{Param: "filter", Token: "one", Offset: 9, Reason: "invalid value"}},
+			{"filter", "a~eq~NaN", ParseError{Param: "filter", Token: "NaN", Offset: 5, Reason: "invalid value"}},
+			{"filter", "a~eq~-Inf", ParseError{Param: "filter", Token: "-Inf", Offset: 5, Reason: "invalid value"}},
+			{"filter", "a~eq~infinity", ParseError{Param: "filter", Token: "infinity", Offset: 5, Reason: "invalid value"}},
+			{"filter", "a~eq~0x1p-2", ParseError{Param: "filter", Token: "0x1p-2", Offset: 5, Reason: "invalid value"}},
+			{"filter", "title~eq~'a')", ParseError{Param: "filter", Token: ")", Offset: 12, Reason: "unexpected token"}},
+			{"filter", "due~eq~date'2020'", ParseError{Param: "filter", Token: "date", Offset: 7, Reason: "unknown literal type"}},
+			{"sort", "name-asc~age", ParseError{Param: "sort", Token: "age", Offset: 9, Reason: `expected "field-value"`}},
+			{"sort", "name-asc~age-up", ParseError{Param: "sort", Token: "up", Offset: 13, Reason: `expected "asc" or "desc"`}},
+			{"group", "name", ParseError{Param: "group", Token: "name", Reason: `expected "field-value"`}},
+			{"group", "name-", ParseError{Param: "group", Token: "name-", Reason: `expected "field-value"`}},
+			{"aggregate", "total-sum~-sum", ParseError{Param: "aggregate", Token: "-sum", Offset: 10, Reason: `expected "field-value"`}},
+			{"pageSize", "-1", ParseError{Param: "pageSize", Token: "-1", Reason: "expected a positive integer"}},
+			{"sort[0][dir]", "up", ParseError{Param: "sort[0][field]", Reason: "expected a field"}},
+			{"sort[0]", "name", ParseError{Param: "sort[0]", Reason: "expected an object"}},
+			{"sort", "name", ParseError{Param: "sort", Token: "name", Reason: `expected "field-value"`}},
+			{"group[0]", "name", ParseError{Param: "group[0]", Reason: "expected an object"}},
+			{"filter[filters][x][field]", "name", ParseError{Param: "filter[filters]", Token: "x", Reason: "expected an index"}},
+			{"filter[filters][0][field", "name", ParseError{Param: "filter[filters][0][field", Reason: "malformed brackets"}},
+			{"filter[filters][0][field]", "name", ParseError{Param: "filter[filters][0]", Reason: "expected a field and an operator"}},
+		}
+
+		for _, tt := range tests {
+			v := url.Values{}
+			v.Set(tt.param, tt.value)
+			d := DataState{}
+			d.values = v
+
+			err := d.parse()
+
+			gotError, ok := err.(*ParseError)
+			if !ok {
+				t.Errorf("DataState.parse(%s=%s) error = %v, want ParseError", tt.param, tt.value, err)
+				continue
+			}
+			gotError.Err = nil
+			if !reflect.DeepEqual(*gotError, tt.wantError) {
+				t.Errorf("DataState.parse(%s=%s) error = %+v, want %+v", tt.param, tt.value, *gotError, tt.wantError)
+			}
+		}
+	})
+
+	t.Run("Should unwrap the underlying error", func(t *testing.T) {
+		v := url.Values{}
+		v.Set("page", "one")
+		d := DataState{}
+		d.values = v
+
+		e, ok := d.parse().(*ParseError)
+		if !ok {
+			t.Fatalf("DataState.parse() error is not a ParseError")
+		}
+		if _, ok := e.Unwrap().(*strconv.NumError); !ok {
+			t.Errorf("ParseError.Unwrap() = %v, want a *strconv.NumError", e.Unwrap())
+		}
+
+		_, err := NewDataStateFromJSON(strings.NewReader(`{"take": "ten"}`))
+		if e, ok := err.(*ParseError); !ok {
+			t.Errorf("NewDataStateFromJSON() error = %v, want a ParseError", err)
+		} else if _, ok := e.Unwrap().(*json.UnmarshalTypeError); !ok {
+			t.Errorf("ParseError.Unwrap() = %v, want a *json.UnmarshalTypeError", e.Unwrap())
+		}
+	})
+
+	t.Run("Should return a ParseError for invalid JSON", func(t *testing.T) {
+		for _, body := range []string{
+			`{"take": 10,`,
+			`{"take": "ten"}`,
+			`{"sort": [{"field": "name", "dir": "up"}]}`,
+			`{"filter": {"logic": "xor", "filters": [{"field": "a", "operator": "eq"}, {"field": "b", "operator": "eq"}]}}`,
+			`{"group": [{"field": "name", "dir": "asc", "aggregates": [{"field": "total"}]}]}`,
+			`{"filter": {"filters": [{"field": "password", "operator": "eq", "value": {"$ne": null}}]}}`,
+			`{"filter": {"filters": [{"field": "name", "operator": "eq", "value": {"$regex": "^(a+)+$"}}]}}`,
+			`{"filter": {"filters": [{"field": "name", "operator": "in", "value": ["a", {"$gt": ""}]}]}}`,
+			`{"filter": {"filters": [{"field": "id", "operator": "eq", "value": {"$oid": "not an id"}}]}}`,
+		} {
+			d, err := NewDataStateFromJSON(strings.NewReader(body))
+			if err == nil {
+				err = d.parse()
+			}
+
+			if _, ok := err.(*ParseError); !ok {
+				t.Errorf("NewDataStateFromJSON(%s) error = %v, want ParseError", body, err)
+			}
+		}
+	})
+
+	t.Run("Should not panic on malformed input", func(t *testing.T) {
+		for _, value := range []string{"", "~", "-", "(", ")", "'", "~~~", "a~", "a~b~", "((((", "a-", "-a", "a--", "[", "]"} {
+			for _, param := range []string{"filter", "sort", "group", "aggregate", "page", "pageSize"} {
+				v := url.Values{}
+				v.Set(param, value)
+				d := DataState{}
+				d.values = v
+
+				if err := d.parse(); err != nil {
+					if _, ok := err.(*ParseError); !ok {
+						t.Errorf("DataState.parse(%s=%s) error = %v, want ParseError", param, value, err)
+					}
+				}
+			}
+		}
+	})
+}
+
+func TestDataState_WithSchema(t *testing.T) {
+	t.Run("Should set DataState schema field", func(t *testing.T) {
+		schema := map[string]FieldType{
+			"age": FieldInt,
+		}
+		d := DataState{}
+		d.WithSchema(schema)
+
+		if !reflect.DeepEqual(d.schema, schema) {
+			t.Errorf("DataState.WithSchema() = %v, want %v", d.schema, schema)
+		}
+	})
+
+	t.Run("Should convert filter values to the type of their field", func(t *testing.T) {
+		v, _ := url.ParseQuery("take=10" +
+			"&filter[filters][0][field]=age&filter[filters][0][operator]=eq&filter[filters][0][value]=5" +
+			"&filter[filters][1][field]=vendorId&filter[filters][1][operator]=eq&filter[filters][1][value]=5c4b3c6e9d1f2a0001a1b2c3" +
+			"&filter[filters][2][field]=active&filter[filters][2][operator]=eq&filter[filters][2][value]=true" +
+			"&filter[filters][3][field]=due&filter[filters][3][operator]=lt&filter[filters][3][value]=2024-03-01T10:15:30Z" +
+			"&filter[filters][4][field]=price&filter[filters][4][operator]=gt&filter[filters][4][value]=5" +
+			"&filter[filters][5][field]=code&filter[filters][5][operator]=eq&filter[filters][5][value]=5" +
+			"&filter[filters][6][field]=code&filter[filters][6][operator]=contains&filter[filters][6][value]=5" +
+			"&filter[filters][7][field]=age&filter[filters][7][operator]=eq&filter[filters][7][value][]=1&filter[filters][7][value][]=2" +
+			"&filter[filters][8][field]=other&filter[filters][8][operator]=eq&filter[filters][8][value]=5" +
+			"&filter[filters][9][field]=age&filter[filters][9][operator]=isnullorempty&filter[filters][9][value]=")
+		d := DataState{}
+		d.values = v
+		d.WithReplacements(map[string]string{
+			"vendorId": "vendor",
+		})
+		d.WithSchema(map[string]FieldType{
+			"age":    FieldInt,
+			"vendor": FieldObjectID,
+			"active": FieldBool,
+			"due":    FieldDate,
+			"price":  FieldFloat,
+			"code":   FieldString,
+		})
+
+		if err := d.parse(); err != nil {
+			t.Fatalf("DataState.parse() error = %v", err)
+		}
+
+		wantValues := []interface{}{
+			int64(5),
+			bson.ObjectIdHex("5c4b3c6e9d1f2a0001a1b2c3"),
+			true,
+			time.Date(2024, 3, 1, 10, 15, 30, 0, time.UTC),
+			float64(5),
+			"5",
+			"5",
+			[]interface{}{int64(1), int64(2)},
+			"5",
+			"",
+		}
+		gotValues := []interface{}{}
+		for _, f := range d.Filter.leaves() {
+			gotValues = append(gotValues, f.Value)
+		}
+		if !reflect.DeepEqual(gotValues, wantValues) {
+			t.Errorf("DataState.parse() = %#v, want %#v", gotValues, wantValues)
+		}
+	})
+
+	t.Run("Should parse dates without offset in the timezone", func(t *testing.T) {
+		paris, err := time.LoadLocation("Europe/Paris")
+		if err != nil {
+			t.Skip("Europe/Paris timezone not available")
+		}
+
+		v := url.Values{}
+		v.Set("filter", "due~eq~datetime'2024-03-01T10-15-30'~and~at~eq~datetime'2024-03-01T10-15-30Z'~and~day~eq~'2024-03-01'")
+		d := DataState{}
+		d.values = v
+		d.WithSchema(map[string]FieldType{"day": FieldDateOnly})
+		d.WithTimezone(paris)
+
+		if err := d.parse(); err != nil {
+			t.Fatalf("DataState.parse() error = %v", err)
+		}
+
+		wantValues := []time.Time{
+			time.Date(2024, 3, 1, 10, 15, 30, 0, paris),
+			time.Date(2024, 3, 1, 10, 15, 30, 0, time.UTC),
+			time.Date(2024, 3, 1, 0, 0, 0, 0, paris),
+		}
+		for i, f := range d.Filter.leaves() {
+			if got, ok := f.Value.(time.Time); !ok || !got.Equal(wantValues[i]) {
+				t.Errorf("DataState.parse() = %v, want %v", f.Value, wantValues[i])
+			}
+		}
+	})
+
+	t.Run("Should return a ConversionError if a value cannot be converted", func(t *testing.T) {
+		tests := []struct {
+			filter    string
+			fieldType FieldType
+		}{
+			{"field~eq~'five'", FieldInt},
+			{"field~eq~5.5", FieldInt},
+			{"field~eq~9223372036854775808.0", FieldInt},
+			{"field~eq~-10000000000000000000.0", FieldInt},
+			{"field~eq~'99999999999999999999'", FieldInt},
+			{"field~eq~'x'", FieldFloat},
+			{"field~eq~'NaN'", FieldFloat},
+			{"field~eq~'yes'", FieldBool},
+			{"field~eq~'tomorrow'", FieldDate},
+			{"field~eq~'123'", FieldObjectID},
+			{"field~eq~true", FieldDate},
+		}
+
+		for _, tt := range tests {
+			v := url.Values{}
+			v.Set("filter", tt.filter)
+			d := DataState{}
+			d.values = v
+			d.WithSchema(map[string]FieldType{
+				"field": tt.fieldType,
+			})
+
+			err := d.parse()
+
+			if e, ok := err.(*ConversionError); !ok || e.Field != "field" || e.Type != tt.fieldType {
+				t.Errorf("DataState.parse(%s) error = %v, want ConversionError", tt.filter, err)
+			}
+		}
+	})
+}
+
+func TestSchemaFromStruct(t *testing.T) {
+	t.Run("Should derive the schema from bson tags", func(t *testing.T) {
+		type Owner struct {
+			Name string `bson:"name"`
+			Age  *int   `bson:"age,omitempty"`
+		}
+		type Base struct {
+			ID      bson.ObjectId `bson:"_id"`
+			Created time.Time     `bson:"createdAt"`
+		}
+		type Item struct {
+			Base     `bson:",inline"`
+			Title    string   `bson:"title"`
+			Price    float64  `bson:"price"`
+			Active   bool     `bson:"active"`
+			Tags     []string `bson:"tags"`
+			Owner    Owner    `bson:"owner"`
+			Previous []Owner  `bson:"previous"`
+			Secret   string   `bson:"-"`
+			Raw      []byte   `bson:"raw"`
+			Count    uint32
+			Ignored  chan bool `bson:"ignored"`
+			internal string
+		}
+
+		wantSchema := map[string]FieldType{
+			"_id":           FieldObjectID,
+			"createdAt":     FieldDate,
+			"title":         FieldString,
+			"price":         FieldFloat,
+			"active":        FieldBool,
+			"tags":          FieldString,
+			"owner.name":    FieldString,
+			"owner.age":     FieldInt,
+			"previous.name": FieldString,
+			"previous.age":  FieldInt,
+			"count":         FieldInt,
+		}
+
+		if gotSchema := SchemaFromStruct(&Item{}); !reflect.DeepEqual(gotSchema, wantSchema) {
+			t.Errorf("SchemaFromStruct() = %v, want %v", gotSchema, wantSchema)
+		}
+	})
+}
+
+func TestDataState_WithLimits(t *testing.T) {
+	t.Run("Should return a LimitError if a limit is exceeded", func(t *testing.T) {
+		tests := []struct {
+			query     string
+			limits    Limits
+			wantError LimitError
+		}{
+			{"pageSize=500", Limits{MaxPageSize: 100}, LimitError{Limit: "MaxPageSize", Max: 100, Value: 500}},
+			{"page=1", Limits{MaxPageSize: 50}, LimitError{Limit: "MaxPageSize", Max: 50, Value: 0}},
+			{"filter=a~eq~1~and~(b~eq~2~or~(c~eq~3~and~d~eq~4))", Limits{MaxFilterDepth: 2}, LimitError{Limit: "MaxFilterDepth", Max: 2, Value: 3}},
+			{"filter=items~any~(a~eq~1~or~(b~eq~2~and~c~eq~3))", Limits{MaxFilterDepth: 2}, LimitError{Limit: "MaxFilterDepth", Max: 2, Value: 3}},
+			{"filter=a~eq~1~and~items~any~(b~eq~2~and~c~eq~3)", Limits{MaxFilters: 3}, LimitError{Limit: "MaxFilters", Max: 3, Value: 4}},
+			{"group=a-asc~b-asc", Limits{MaxGroups: 1}, LimitError{Limit: "MaxGroups", Max: 1, Value: 2}},
+			{"group[0][field]=a&group[0][dir]=asc&group[0][aggregates][0][field]=x&group[0][aggregates][0][aggregate]=sum&aggregate[0][field]=x&aggregate[0][aggregate]=max", Limits{MaxAggregates: 1}, LimitError{Limit: "MaxAggregates", Max: 1, Value: 2}},
+			{"filter=a~in~['abc','abcdef']", Limits{MaxStringLength: 5}, LimitError{Limit: "MaxStringLength", Max: 5, Value: 6}},
+			{"search=abcdef", Limits{MaxStringLength: 5}, LimitError{Limit: "MaxStringLength", Max: 5, Value: 6}},
+			{"page=101&pageSize=10", Limits{MaxSkip: 999}, LimitError{Limit: "MaxSkip", Max: 999, Value: 1000}},
+		}
+
+		for _, tt := range tests {
+			d := DataState{}
+			d.values, _ = url.ParseQuery(tt.query)
+			d.WithLimits(tt.limits)
+
+			err := d.parse()
+
+			gotError, ok := err.(*LimitError)
+			if !ok {
+				t.Errorf("DataState.parse(%s) error = %v, want LimitError", tt.query, err)
+				continue
+			}
+			if !reflect.DeepEqual(*gotError, tt.wantError) {
+				t.Errorf("DataState.parse(%s) error = %+v, want %+v", tt.query, *gotError, tt.wantError)
+			}
+		}
+	})
+
+	t.Run("Should clamp the page size", func(t *testing.T) {
+		d := DataState{}
+		d.values, _ = url.ParseQuery("page=3&pageSize=500&filter=(a~eq~1~or~b~eq~2)")
+		d.WithLimits(Limits{MaxPageSize: 100, ClampPageSize: true, MaxSkip: 200, MaxFilterDepth: 1, MaxFilters: 2})
+
+		if err := d.parse(); err != nil {
+			t.Fatalf("DataState.parse() error = %v", err)
+		}
+
+		if d.PageSize != 100 {
+			t.Errorf("DataState.parse() PageSize = %v, want %v", d.PageSize, 100)
+		}
+	})
+
+	t.Run("Should page without page size", func(t *testing.T) {
+		for _, d := range []*DataState{
+			{values: url.Values{"filter": {"a~eq~1"}}},
+			{request: &dataSourceRequest{Skip: 20}},
+		} {
+			d.WithLimits(Limits{MaxPageSize: 50, ClampPageSize: true})
+
+			if err := d.parse(); err != nil {
+				t.Fatalf("DataState.parse() error = %v", err)
+			}
+
+			wantPaging := []bson.M{{"$skip": 0}, {"$limit": 50}}
+			if gotPaging := d.getPaging(); d.PageSize != 50 || !reflect.DeepEqual(gotPaging, wantPaging) {
+				t.Errorf("DataState.getPaging() = %v, want %v", gotPaging, wantPaging)
+			}
+		}
+	})
+}
+
+func TestDataState_WithFieldPolicies(t *testing.T) {
+	policies := map[string]FieldPolicy{
+		"name":       {Filterable: true, Sortable: true, Operators: []string{"eq", "contains"}},
+		"status":     {Filterable: true, Groupable: true},
+		"price":      {Aggregatable: true},
+		"items":      {Filterable: true, Operators: []string{"any"}},
+		"items.sku":  {Filterable: true},
+		"owner.name": {Sortable: true},
+	}
+
+	t.Run("Should accept the allowed fields", func(t *testing.T) {
+		d := DataState{}
+		d.values, _ = url.ParseQuery("filter=name~contains~'a'~and~status~neq~'x'~and~items~any~(sku~eq~'X')" +
+			"&sort=name-asc~owner.name-desc&group=status-asc&aggregate=price-sum")
+		d.WithFieldPolicies(policies)
+
+		if err := d.parse(); err != nil {
+			t.Fatalf("DataState.parse() error = %v", err)
+		}
+	})
+
+	t.Run("Should return a PolicyError if a field is not allowed", func(t *testing.T) {
+		tests := []struct {
+			query     string
+			wantError PolicyError
+		}{
+			{"filter=passwordHash~eq~'x'", PolicyError{Field: "passwordHash", Reason: "not exposed"}},
+			{"filter=name~startswith~'x'", PolicyError{Field: "name", Operator: "startswith", Reason: "not allowed"}},
+			{"filter=price~gt~5", PolicyError{Field: "price", Reason: "not filterable"}},
+			{"filter=items~any~(qty~gt~5)", PolicyError{Field: "items.qty", Reason: "not exposed"}},
+			{"filter=items~all~(sku~eq~'X')", PolicyError{Field: "items", Operator: "all", Reason: "not allowed"}},
+			{"filter=lines~any~(sku~eq~'X')", PolicyError{Field: "lines", Reason: "not exposed"}},
+			{"filter=status~any~(sku~eq~'X')", PolicyError{Field: "status.sku", Reason: "not exposed"}},
+			{"sort=status-asc", PolicyError{Field: "status", Reason: "not sortable"}},
+			{"group=name-asc", PolicyError{Field: "name", Reason: "not groupable"}},
+			{"group[0][field]=status&group[0][dir]=asc&group[0][aggregates][0][field]=name&group[0][aggregates][0][aggregate]=sum", PolicyError{Field: "name", Reason: "not aggregatable"}},
+		}
+
+		for _, tt := range tests {
+			d := DataState{}
+			d.values, _ = url.ParseQuery(tt.query)
+			d.WithFieldPolicies(policies)
+
+			err := d.parse()
+
+			gotError, ok := err.(*PolicyError)
+			if !ok {
+				t.Errorf("DataState.parse(%s) error = %v, want PolicyError", tt.query, err)
+				continue
+			}
+			if !reflect.DeepEqual(*gotError, tt.wantError) {
+				t.Errorf("DataState.parse(%s) error = %+v, want %+v", tt.query, *gotError, tt.wantError)
+			}
+		}
+	})
+
+	t.Run("Should reject fields looking like operators without policies", func(t *testing.T) {
+		for _, query := range []string{"filter=$where~eq~'x'", "sort=a.$b-asc", "group=$a-asc", "aggregate=$a-sum"} {
+			d := DataState{}
+			d.values, _ = url.ParseQuery(query)
+
+			if e, ok := d.parse().(*PolicyError); !ok || e.Reason != "invalid name" {
+				t.Errorf("DataState.parse(%s) error = %v, want PolicyError", query, e)
+			}
+		}
 	})
 }
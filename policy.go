@@ -0,0 +1,174 @@
+package kendo
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// FieldPolicy declares what clients can do with an exposed field
+type FieldPolicy struct {
+	Filterable   bool
+	Sortable     bool
+	Groupable    bool
+	Aggregatable bool
+	Operators    []string // operators allowed in filters, any if empty
+}
+
+// PolicyError is returned when a request uses a field in a way its FieldPolicy does not allow
+type PolicyError struct {
+	Field    string
+	Operator string // only set for operators that are not allowed
+	Reason   string // e.g. "not exposed" or "not sortable"
+}
+
+func (e *PolicyError) Error() string {
+	if e.Operator != "" {
+		return fmt.Sprintf("kendo: field %s: operator %q %s", e.Field, e.Operator, e.Reason)
+	}
+
+	return fmt.Sprintf("kendo: field %s: %s", e.Field, e.Reason)
+}
+
+// WithFieldPolicies restricts the fields, after replacement, clients can use to the ones of policies
+// (e.g. "owner.name" for a nested field) and the output documents to these fields and id.
+// Without policies any field can be used.
+func (d *DataState) WithFieldPolicies(policies map[string]FieldPolicy) {
+	d.policies = policies
+}
+
+func (d *DataState) checkPolicies() error {
+
+	// the array field of a sub-filter is checked, then the fields of the sub-filter
+	err := walkLeaves(&d.Filter, "", func(path string, f *FilterDescriptor) error {
+		policy, err := d.getFieldPolicy(path)
+		if err != nil || d.policies == nil {
+			return err
+		}
+		if !policy.Filterable {
+			return &PolicyError{Field: path, Reason: "not filterable"}
+		}
+		if len(policy.Operators) > 0 && !containsString(policy.Operators, f.Operator) {
+			return &PolicyError{Field: path, Operator: f.Operator, Reason: "not allowed"}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, s := range d.Sort {
+		if err := d.checkCapability(s.Field, "sortable", func(p FieldPolicy) bool { return p.Sortable }); err != nil {
+			return err
+		}
+	}
+
+	aggregates := []AggregateDescriptor{}
+	aggregates = append(aggregates, d.Aggregates...)
+	for _, g := range d.Group {
+		if err := d.checkCapability(g.Field, "groupable", func(p FieldPolicy) bool { return p.Groupable }); err != nil {
+			return err
+		}
+		aggregates = append(aggregates, g.Aggregates...)
+	}
+
+	for _, a := range aggregates {
+		if err := d.checkCapability(a.Field, "aggregatable", func(p FieldPolicy) bool { return p.Aggregatable }); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getFieldPolicy returns the policy of the field, or a PolicyError if the field looks like
+// an operator or there are policies and the field is not exposed
+func (d *DataState) getFieldPolicy(field string) (policy FieldPolicy, err error) {
+
+	for _, segment := range strings.Split(field, ".") {
+		if strings.HasPrefix(segment, "$") {
+			return policy, &PolicyError{Field: field, Reason: "invalid name"}
+		}
+	}
+
+	if d.policies == nil {
+		return
+	}
+
+	policy, ok := d.policies[field]
+	if !ok {
+		return policy, &PolicyError{Field: field, Reason: "not exposed"}
+	}
+
+	return
+}
+
+// checkCapability returns a PolicyError if the field cannot be used as capability (e.g. "sortable")
+func (d *DataState) checkCapability(field string, capability string, allowed func(FieldPolicy) bool) error {
+
+	policy, err := d.getFieldPolicy(field)
+	if err != nil || d.policies == nil {
+		return err
+	}
+
+	if !allowed(policy) {
+		return &PolicyError{Field: field, Reason: "not " + capability}
+	}
+
+	return nil
+}
+
+// getExposedProject returns the $project stage keeping the exposed fields and id, or nil without policies
+func (d *DataState) getExposedProject() bson.M {
+
+	if d.policies == nil {
+		return nil
+	}
+
+	fields := []string{"id"}
+	if tiebreaker := d.getTiebreaker(); tiebreaker != "" {
+		fields = append(fields, tiebreaker)
+	}
+	for field := range d.policies {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields) // parents first
+
+	project := bson.M{}
+	for _, field := range fields {
+		if !includesParent(project, field) {
+			project[field] = 1
+		}
+	}
+
+	return bson.M{
+		"$project": project,
+	}
+}
+
+// includesParent reports whether the field, or one of its parents, is already projected
+func includesParent(project bson.M, field string) bool {
+
+	for i := range field {
+		if field[i] == '.' {
+			if _, ok := project[field[:i]]; ok {
+				return true
+			}
+		}
+	}
+	_, ok := project[field]
+
+	return ok
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
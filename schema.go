@@ -0,0 +1,333 @@
+package kendo
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// FieldType is the storage type of a field, filter values are converted to it
+type FieldType int
+
+const (
+	FieldAny FieldType = iota // values are kept as parsed
+	FieldString
+	FieldInt // int64
+	FieldFloat
+	FieldBool
+	FieldDate
+	FieldObjectID
+	FieldDateOnly // a date, compared by day in the timezone of the DataState
+)
+
+func (ft FieldType) String() string {
+	switch ft {
+	case FieldString:
+		return "string"
+	case FieldInt:
+		return "int"
+	case FieldFloat:
+		return "float"
+	case FieldBool:
+		return "bool"
+	case FieldDate:
+		return "date"
+	case FieldObjectID:
+		return "ObjectId"
+	case FieldDateOnly:
+		return "date only"
+	}
+
+	return "any"
+}
+
+// ConversionError is returned when a filter value cannot be converted to the type of its field
+type ConversionError struct {
+	Field string
+	Value interface{}
+	Type  FieldType
+	Err   error
+}
+
+func (e *ConversionError) Error() string {
+	msg := fmt.Sprintf("kendo: cannot convert %v to %s for field %s", e.Value, e.Type, e.Field)
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+
+	return msg
+}
+
+// Unwrap returns the underlying error of the conversion
+func (e *ConversionError) Unwrap() error {
+	return e.Err
+}
+
+// WithSchema declares the storage type of fields, after replacement.
+// For example map[string]FieldType{ "id": FieldObjectID, "age": FieldInt }
+func (d *DataState) WithSchema(schema map[string]FieldType) {
+	d.schema = schema
+}
+
+var (
+	timeType     = reflect.TypeOf(time.Time{})
+	objectIDType = reflect.TypeOf(bson.ObjectId(""))
+)
+
+// SchemaFromStruct derives a schema from the bson tags of a struct, nested structs
+// are declared with dotted fields (e.g. "owner.name") and slices with the type of their elements
+func SchemaFromStruct(v interface{}) map[string]FieldType {
+	schema := map[string]FieldType{}
+	addStructFields(schema, "", reflect.TypeOf(v))
+
+	return schema
+}
+
+func addStructFields(schema map[string]FieldType, prefix string, t reflect.Type) {
+
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" && !field.Anonymous { // unexported
+			continue
+		}
+
+		name, inline := bsonName(field)
+		if name == "-" {
+			continue
+		}
+		if inline {
+			addStructFields(schema, prefix, field.Type)
+			continue
+		}
+
+		name = prefix + name
+		fieldType := field.Type
+		if fieldType.Kind() == reflect.Slice && fieldType.Elem().Kind() == reflect.Uint8 { // binary
+			continue
+		}
+		for fieldType.Kind() == reflect.Ptr || fieldType.Kind() == reflect.Slice || fieldType.Kind() == reflect.Array {
+			fieldType = fieldType.Elem()
+		}
+
+		switch {
+		case fieldType == timeType:
+			schema[name] = FieldDate
+		case fieldType == objectIDType:
+			schema[name] = FieldObjectID
+		case fieldType.Kind() == reflect.String:
+			schema[name] = FieldString
+		case fieldType.Kind() == reflect.Bool:
+			schema[name] = FieldBool
+		case fieldType.Kind() >= reflect.Int && fieldType.Kind() <= reflect.Uint64:
+			schema[name] = FieldInt
+		case fieldType.Kind() == reflect.Float32 || fieldType.Kind() == reflect.Float64:
+			schema[name] = FieldFloat
+		case fieldType.Kind() == reflect.Struct:
+			addStructFields(schema, name+".", fieldType)
+		}
+	}
+}
+
+// bsonName returns the key of a struct field following the mgo/bson conventions
+func bsonName(field reflect.StructField) (name string, inline bool) {
+
+	tag := field.Tag.Get("bson")
+	if tag == "" && !strings.Contains(string(field.Tag), ":") {
+		tag = string(field.Tag)
+	}
+
+	parts := strings.Split(tag, ",")
+	for _, flag := range parts[1:] {
+		if flag == "inline" {
+			inline = true
+		}
+	}
+
+	name = parts[0]
+	if name == "" {
+		name = strings.ToLower(field.Name)
+	}
+
+	return
+}
+
+// coerceFilter converts the values of the filter to the type of their field
+func (d *DataState) coerceFilter() error {
+
+	if len(d.schema) == 0 {
+		return nil
+	}
+
+	return walkLeaves(&d.Filter, "", func(path string, f *FilterDescriptor) error {
+		fieldType, ok := d.schema[path]
+		if _, isFilter := f.Value.(Filter); !ok || isFilter || f.Value == nil || f.Operator == "size" ||
+			isPatternOperator(f.Operator) || isUnaryOperator(f.Operator) {
+			return nil
+		}
+
+		value, err := coerce(f.Value, fieldType, d.getLocation())
+		if err != nil {
+			return &ConversionError{
+				Field: path,
+				Value: f.Value,
+				Type:  fieldType,
+				Err:   err,
+			}
+		}
+		f.Value = value
+
+		return nil
+	})
+}
+
+func coerce(value interface{}, fieldType FieldType, loc *time.Location) (interface{}, error) {
+
+	if list, ok := value.([]interface{}); ok {
+		coerced := make([]interface{}, len(list))
+		for i := range list {
+			v, err := coerce(list[i], fieldType, loc)
+			if err != nil {
+				return nil, err
+			}
+			coerced[i] = v
+		}
+		return coerced, nil
+	}
+
+	if value == nil {
+		return nil, nil
+	}
+
+	switch fieldType {
+	case FieldString:
+		return toString(value)
+	case FieldInt:
+		return toInt(value)
+	case FieldFloat:
+		return toFloat(value)
+	case FieldBool:
+		return toBool(value)
+	case FieldDate, FieldDateOnly:
+		return toDate(value, loc)
+	case FieldObjectID:
+		return toObjectID(value)
+	}
+
+	return value, nil
+}
+
+func toString(value interface{}) (interface{}, error) {
+
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case bson.ObjectId:
+		return v.Hex(), nil
+	case time.Time:
+		return v.Format(time.RFC3339Nano), nil
+	}
+
+	return nil, errors.New("unsupported type")
+}
+
+func toInt(value interface{}) (interface{}, error) {
+
+	switch v := value.(type) {
+	case int64:
+		return v, nil
+	case int:
+		return int64(v), nil
+	case int32:
+		return int64(v), nil
+	case float64:
+		if v != math.Trunc(v) || math.IsInf(v, 0) {
+			return nil, errors.New("not an integer")
+		}
+		if v < math.MinInt64 || v >= math.MaxInt64 { // float64(math.MaxInt64) rounds up to 2^63
+			return nil, errors.New("out of the int64 range")
+		}
+		return int64(v), nil
+	case string:
+		return strconv.ParseInt(v, 10, 64)
+	}
+
+	return nil, errors.New("unsupported type")
+}
+
+func toFloat(value interface{}) (interface{}, error) {
+
+	switch v := value.(type) {
+	case float64:
+		return v, nil
+	case int64:
+		return float64(v), nil
+	case int:
+		return float64(v), nil
+	case int32:
+		return float64(v), nil
+	case string:
+		if !numberPattern.MatchString(v) {
+			return nil, errors.New("not a number")
+		}
+		return strconv.ParseFloat(v, 64)
+	}
+
+	return nil, errors.New("unsupported type")
+}
+
+func toBool(value interface{}) (interface{}, error) {
+
+	switch v := value.(type) {
+	case bool:
+		return v, nil
+	case string:
+		return strconv.ParseBool(v)
+	}
+
+	return nil, errors.New("unsupported type")
+}
+
+func toDate(value interface{}, loc *time.Location) (interface{}, error) {
+
+	switch v := value.(type) {
+	case time.Time:
+		return v, nil
+	case int64: // milliseconds since epoch, as JavaScript
+		return time.Unix(0, v*int64(time.Millisecond)).UTC(), nil
+	case string:
+		return parseDateTimeIn(v, loc)
+	}
+
+	return nil, errors.New("unsupported type")
+}
+
+func toObjectID(value interface{}) (interface{}, error) {
+
+	switch v := value.(type) {
+	case bson.ObjectId:
+		return v, nil
+	case string:
+		return parseObjectID(v)
+	}
+
+	return nil, errors.New("unsupported type")
+}
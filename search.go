@@ -0,0 +1,65 @@
+package kendo
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// WithSearchFields declares the fields, after replacement, matched by the Search term.
+// A document matches if one of the fields contains the term, ignoring case, in addition to the filter.
+func (d *DataState) WithSearchFields(fields []string) {
+	d.searchFields = fields
+}
+
+// WithTextSearch matches the Search term with the text index of the collection ($text)
+// instead of regular expressions on the search fields
+func (d *DataState) WithTextSearch(enabled bool) {
+	d.textSearch = enabled
+}
+
+// getSearch returns the condition matching the search term on the search fields, or nil if there is none
+func (d *DataState) getSearch() bson.M {
+
+	term := strings.TrimSpace(d.Search)
+	if term == "" || d.textSearch || len(d.searchFields) == 0 {
+		return nil
+	}
+
+	pattern := regexp.QuoteMeta(term)
+	conditions := make([]bson.M, len(d.searchFields))
+	for i, field := range d.searchFields {
+		conditions[i] = bson.M{
+			field: bson.M{
+				"$regex":   pattern,
+				"$options": "i",
+			},
+		}
+	}
+
+	if len(conditions) == 1 {
+		return conditions[0]
+	}
+
+	return bson.M{
+		"$or": conditions,
+	}
+}
+
+// getTextSearch returns the $text stage, which has to be the first stage of the pipeline, or nil
+func (d *DataState) getTextSearch() bson.M {
+
+	term := strings.TrimSpace(d.Search)
+	if term == "" || !d.textSearch {
+		return nil
+	}
+
+	return bson.M{
+		"$match": bson.M{
+			"$text": bson.M{
+				"$search": term,
+			},
+		},
+	}
+}